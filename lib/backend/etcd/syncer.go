@@ -295,9 +295,9 @@ func (syn *etcdSyncer) mergeUpdates(snapshotUpdates <-chan event, watcherUpdates
 
 func (syn *etcdSyncer) sendUpdate(key string, value *string, revision uint64) {
 	glog.V(4).Infof("Parsing etcd key %#v", key)
-	parsedKey := model.KeyFromDefaultPath(key)
-	if parsedKey == nil {
-		glog.V(3).Infof("Failed to parse key %v", key)
+	parsedKey, err := model.KeyFromDefaultPath(key)
+	if err != nil {
+		glog.V(3).Infof("Failed to parse key %v: %v", key, err)
 		if cb, ok := syn.callbacks.(api.SyncerParseFailCallbacks); ok {
 			cb.ParseFailed(key, value)
 		}
@@ -306,11 +306,10 @@ func (syn *etcdSyncer) sendUpdate(key string, value *string, revision uint64) {
 	glog.V(4).Infof("Parsed etcd key: %v", parsedKey)
 
 	var parsedValue interface{}
-	var err error
 	if value != nil {
 		parsedValue, err = model.ParseValue(parsedKey, []byte(*value))
 		if err != nil {
-			glog.Warningf("Failed to parse value for %v: %#v", key, *value)
+			glog.Warningf("Failed to parse value for %v: %#v: %v", key, *value, err)
 		}
 		glog.V(4).Infof("Parsed value: %#v", parsedValue)
 	}
@@ -323,9 +322,9 @@ func (syn *etcdSyncer) sendUpdate(key string, value *string, revision uint64) {
 func (syn *etcdSyncer) sendDeletions(deletedKeys []string, revision uint64) {
 	updates := make([]model.KVPair, 0, len(deletedKeys))
 	for _, key := range deletedKeys {
-		parsedKey := model.KeyFromDefaultPath(key)
-		if parsedKey == nil {
-			glog.V(3).Infof("Failed to parse key %v", key)
+		parsedKey, err := model.KeyFromDefaultPath(key)
+		if err != nil {
+			glog.V(3).Infof("Failed to parse key %v: %v", key, err)
 			if cb, ok := syn.callbacks.(api.SyncerParseFailCallbacks); ok {
 				cb.ParseFailed(key, nil)
 			}
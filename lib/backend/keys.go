@@ -0,0 +1,42 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"regexp"
+
+	"github.com/tigera/libcalico-go/lib/backend/model"
+)
+
+// matchFelixProfileKey matches the bare profile directory that KeyToFelixKey
+// returns for a ProfileKey.  The model's key registry doesn't parse it, since
+// the datastore only holds values under the profile's tags, rules and labels.
+var matchFelixProfileKey = regexp.MustCompile("^/?calico/v1/policy/profile/([^/]+)$")
+
+// KeyToFelixKey converts a model key to the string form that is written to
+// etcd and read by Felix.
+func KeyToFelixKey(key model.Key) (string, error) {
+	return model.KeyToDefaultPath(key)
+}
+
+// KeyFromFelixKey is the inverse of KeyToFelixKey; it parses a key string in
+// the etcd/Felix path layout back into the corresponding model key.  An
+// errors.ErrorUnrecognizedPath is returned if the string is not a known key.
+func KeyFromFelixKey(s string) (model.Key, error) {
+	if m := matchFelixProfileKey.FindStringSubmatch(s); m != nil {
+		return model.ProfileKey{Name: m[1]}, nil
+	}
+	return model.KeyFromDefaultPath(s)
+}
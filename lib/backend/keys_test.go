@@ -0,0 +1,52 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend_test
+
+import (
+	. "github.com/tigera/libcalico-go/lib/backend"
+
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tigera/libcalico-go/lib/backend/model"
+	"github.com/tigera/libcalico-go/lib/errors"
+)
+
+var felixKeyTests = []model.Key{
+	model.PolicyKey{Tier: "t", Name: "p"},
+	model.ProfileKey{Name: "p"},
+	model.WorkloadEndpointKey{Hostname: "h", OrchestratorID: "o", WorkloadID: "w", EndpointID: "e"},
+	model.HostEndpointKey{Hostname: "h", EndpointID: "e"},
+}
+
+var _ = Describe("KeyFromFelixKey", func() {
+	for _, key := range felixKeyTests {
+		key := key // For closure
+		It(fmt.Sprintf("should round-trip %v", key), func() {
+			s, err := KeyToFelixKey(key)
+			Expect(err).To(BeNil())
+			parsed, err := KeyFromFelixKey(s)
+			Expect(err).To(BeNil())
+			Expect(parsed).To(Equal(key))
+		})
+	}
+
+	It("should return an error for an unrecognized key", func() {
+		key, err := KeyFromFelixKey("/calico/v1/unknown/foo")
+		Expect(key).To(BeNil())
+		Expect(err).To(Equal(errors.ErrorUnrecognizedPath{Path: "/calico/v1/unknown/foo"}))
+	})
+})
@@ -0,0 +1,178 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model_test
+
+import (
+	. "github.com/tigera/libcalico-go/lib/backend/model"
+
+	"encoding/json"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tigera/libcalico-go/lib/numorstring"
+)
+
+// binaryTestRules covers every field of a Rule.
+var binaryTestRules = []Rule{
+	{},
+	{Action: "deny", IPVersion: &ipv6, Protocol: &intProto, NotProtocol: &tcpProto},
+	{Protocol: &icmpProto, ICMPType: &icmpType, ICMPCode: &icmpCode, NotICMPType: &icmpCode, NotICMPCode: &icmpType},
+	{
+		Action:         "next-tier",
+		IPVersion:      &ipv4,
+		SrcTag:         "src",
+		SrcNet:         cidr,
+		SrcSelector:    `a == "b"`,
+		SrcPorts:       ports,
+		DstTag:         "dst",
+		DstSelector:    "has(c)",
+		DstNet:         cidr,
+		DstPorts:       ports2,
+		NotSrcTag:      "notsrc",
+		NotSrcNet:      cidr,
+		NotSrcSelector: "all()",
+		NotSrcPorts:    ports2,
+		NotDstTag:      "notdst",
+		NotDstSelector: `d in {"e"}`,
+		NotDstNet:      cidr,
+		NotDstPorts:    ports,
+	},
+	{Action: "log", SrcNet: cidrV6, LogPrefix: "dropped: "},
+}
+
+// jsonRoundTrip returns the result of encoding v as JSON and decoding it into
+// out.
+func jsonRoundTrip(v interface{}, out interface{}) interface{} {
+	data, err := json.Marshal(v)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(json.Unmarshal(data, out)).To(Succeed())
+	return out
+}
+
+var _ = Describe("Binary encoding", func() {
+	zero := float32(0)
+	policies := []Policy{
+		{},
+		{Order: &zero},
+		{Order: orderPtr(-10.5), Selector: `has(a) && b == "c"`},
+		{Order: orderPtr(1000), InboundRules: binaryTestRules, OutboundRules: binaryTestRules[1:3]},
+	}
+
+	It("should round trip policies as JSON does", func() {
+		for _, policy := range policies {
+			data, err := policy.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			var decoded Policy
+			Expect(decoded.UnmarshalBinary(data)).To(Succeed())
+			Expect(&decoded).To(Equal(jsonRoundTrip(policy, &Policy{})), policy.String())
+		}
+	})
+
+	It("should round trip rules as JSON does", func() {
+		for _, rule := range binaryTestRules {
+			data, err := rule.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			var decoded Rule
+			Expect(decoded.UnmarshalBinary(data)).To(Succeed())
+			Expect(&decoded).To(Equal(jsonRoundTrip(rule, &Rule{})), rule.String())
+		}
+	})
+
+	It("should round trip profile rules as JSON does", func() {
+		for _, rules := range []ProfileRules{{}, {InboundRules: binaryTestRules}, {OutboundRules: binaryTestRules}} {
+			data, err := rules.MarshalBinary()
+			Expect(err).NotTo(HaveOccurred())
+			var decoded ProfileRules
+			Expect(decoded.UnmarshalBinary(data)).To(Succeed())
+			Expect(&decoded).To(Equal(jsonRoundTrip(rules, &ProfileRules{})))
+		}
+	})
+
+	It("should be smaller than JSON", func() {
+		policy := policies[len(policies)-1]
+		data, err := policy.MarshalBinary()
+		Expect(err).NotTo(HaveOccurred())
+		jsonData, err := json.Marshal(policy)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(data)).To(BeNumerically("<", len(jsonData)/2))
+	})
+
+	It("should reject invalid data", func() {
+		data, err := policies[len(policies)-1].MarshalBinary()
+		Expect(err).NotTo(HaveOccurred())
+		var decoded Policy
+		Expect(decoded.UnmarshalBinary(nil)).To(MatchError("truncated binary data"))
+		for _, l := range []int{1, 10, len(data) / 2, len(data) - 1} {
+			Expect(decoded.UnmarshalBinary(data[:l])).To(MatchError("truncated binary data"))
+		}
+		Expect(decoded.UnmarshalBinary(append(data, 0))).To(MatchError(
+			"1 bytes of unexpected trailing binary data"))
+		badVersion := append([]byte{2}, data[1:]...)
+		Expect(decoded.UnmarshalBinary(badVersion)).To(MatchError("unsupported binary format version 2"))
+		Expect(decoded).To(Equal(Policy{}))
+	})
+
+	It("should fail to encode an invalid port, as JSON does", func() {
+		rule := Rule{SrcPorts: []numorstring.Port{{Int32OrString: numorstring.Int32OrString{Type: 5}}}}
+		_, err := rule.MarshalBinary()
+		Expect(err).To(MatchError("impossible Int32OrString.Type 5"))
+		_, err = json.Marshal(rule)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var benchmarkPolicy = Policy{
+	Order:         orderPtr(10),
+	Selector:      `role == "web" && has(env)`,
+	InboundRules:  binaryTestRules,
+	OutboundRules: binaryTestRules,
+}
+
+func BenchmarkPolicyMarshalJSON(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(benchmarkPolicy); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPolicyMarshalBinary(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := benchmarkPolicy.MarshalBinary(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPolicyUnmarshalJSON(b *testing.B) {
+	data, _ := json.Marshal(benchmarkPolicy)
+	for i := 0; i < b.N; i++ {
+		var p Policy
+		if err := json.Unmarshal(data, &p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPolicyUnmarshalBinary(b *testing.B) {
+	data, _ := benchmarkPolicy.MarshalBinary()
+	for i := 0; i < b.N; i++ {
+		var p Policy
+		if err := p.UnmarshalBinary(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -32,6 +32,18 @@ var (
 	typeReadyFlag     = rawBoolType
 )
 
+func init() {
+	RegisterKeyPath(matchGlobalConfig, func(m []string) (Key, error) {
+		return GlobalConfigKey{Name: m[1]}, nil
+	})
+	RegisterKeyPath(matchHostConfig, func(m []string) (Key, error) {
+		return HostConfigKey{Hostname: m[1], Name: m[2]}, nil
+	})
+	RegisterKeyPath(matchReadyFlag, func(m []string) (Key, error) {
+		return ReadyFlagKey{}, nil
+	})
+}
+
 type ReadyFlagKey struct {
 }
 
@@ -0,0 +1,64 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+// Endpoint is implemented by the endpoint types, WorkloadEndpoint and
+// HostEndpoint, so that code that only cares about an endpoint's labels
+// and profiles can handle both uniformly.
+type Endpoint interface {
+	EndpointLabels() map[string]string
+	EndpointProfileIDs() []string
+}
+
+var _ Endpoint = WorkloadEndpoint{}
+var _ Endpoint = HostEndpoint{}
+
+func (e WorkloadEndpoint) EndpointLabels() map[string]string {
+	return e.Labels
+}
+
+func (e WorkloadEndpoint) EndpointProfileIDs() []string {
+	return e.ProfileIDs
+}
+
+func (e HostEndpoint) EndpointLabels() map[string]string {
+	return e.Labels
+}
+
+func (e HostEndpoint) EndpointProfileIDs() []string {
+	return e.ProfileIDs
+}
+
+// EndpointLabelsAndProfiles returns the labels and profile IDs of an
+// endpoint value, as stored in a KVPair.  ok is false if the value is not
+// an endpoint (for example, if it is nil, or a nil pointer, because the
+// endpoint was deleted).
+func EndpointLabelsAndProfiles(value interface{}) (labels map[string]string, profileIDs []string, ok bool) {
+	switch endpoint := value.(type) {
+	case *WorkloadEndpoint:
+		if endpoint == nil {
+			return nil, nil, false
+		}
+	case *HostEndpoint:
+		if endpoint == nil {
+			return nil, nil, false
+		}
+	}
+	endpoint, ok := value.(Endpoint)
+	if !ok {
+		return nil, nil, false
+	}
+	return endpoint.EndpointLabels(), endpoint.EndpointProfileIDs(), true
+}
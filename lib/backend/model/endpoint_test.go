@@ -0,0 +1,59 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model_test
+
+import (
+	. "github.com/tigera/libcalico-go/lib/backend/model"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var endpointTests = []struct {
+	description   string
+	value         interface{}
+	expLabels     map[string]string
+	expProfileIDs []string
+	expOK         bool
+}{
+	{"workload endpoint",
+		WorkloadEndpoint{Labels: map[string]string{"a": "b"}, ProfileIDs: []string{"p1"}},
+		map[string]string{"a": "b"}, []string{"p1"}, true},
+	{"workload endpoint pointer",
+		&WorkloadEndpoint{Labels: map[string]string{"a": "b"}, ProfileIDs: []string{"p1"}},
+		map[string]string{"a": "b"}, []string{"p1"}, true},
+	{"host endpoint",
+		HostEndpoint{Labels: map[string]string{"c": "d"}, ProfileIDs: []string{"p2", "p3"}},
+		map[string]string{"c": "d"}, []string{"p2", "p3"}, true},
+	{"host endpoint pointer",
+		&HostEndpoint{Labels: map[string]string{"c": "d"}, ProfileIDs: []string{"p2", "p3"}},
+		map[string]string{"c": "d"}, []string{"p2", "p3"}, true},
+	{"deleted endpoint", nil, nil, nil, false},
+	{"nil workload endpoint pointer", (*WorkloadEndpoint)(nil), nil, nil, false},
+	{"nil host endpoint pointer", (*HostEndpoint)(nil), nil, nil, false},
+	{"non-endpoint value", Policy{}, nil, nil, false},
+}
+
+var _ = Describe("EndpointLabelsAndProfiles", func() {
+	for _, test := range endpointTests {
+		test := test // For closure
+		It("should handle a "+test.description, func() {
+			labels, profileIDs, ok := EndpointLabelsAndProfiles(test.value)
+			Expect(ok).To(Equal(test.expOK))
+			Expect(labels).To(Equal(test.expLabels))
+			Expect(profileIDs).To(Equal(test.expProfileIDs))
+		})
+	}
+})
@@ -31,6 +31,15 @@ var (
 	typeHostEndpoint  = reflect.TypeOf(HostEndpoint{})
 )
 
+func init() {
+	RegisterKeyPath(matchHostEndpoint, func(m []string) (Key, error) {
+		return HostEndpointKey{
+			Hostname:   m[1],
+			EndpointID: m[2],
+		}, nil
+	})
+}
+
 type HostEndpointKey struct {
 	Hostname   string `json:"-" validate:"required,hostname"`
 	EndpointID string `json:"-" validate:"required,hostname"`
@@ -43,6 +52,9 @@ func (key HostEndpointKey) defaultPath() (string, error) {
 	if key.EndpointID == "" {
 		return "", errors.ErrorInsufficientIdentifiers{Name: "name"}
 	}
+	if err := checkPathSegments([]string{"hostname", "name"}, key.Hostname, key.EndpointID); err != nil {
+		return "", err
+	}
 	e := fmt.Sprintf("/calico/v1/host/%s/endpoint/%s",
 		key.Hostname, key.EndpointID)
 	return e, nil
@@ -25,6 +25,12 @@ var (
 	typeHostIp  = reflect.TypeOf(HostIP{})
 )
 
+func init() {
+	RegisterKeyPath(matchHostIp, func(m []string) (Key, error) {
+		return HostIPKey{Hostname: m[1]}, nil
+	})
+}
+
 // TODO find a place to put this
 type HostIPKey struct {
 	Hostname string
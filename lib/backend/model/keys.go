@@ -17,10 +17,11 @@ package model
 import (
 	"encoding/json"
 	"reflect"
+	"regexp"
 	"strings"
 
 	"github.com/golang/glog"
-	"github.com/tigera/libcalico-go/lib/net"
+	"github.com/tigera/libcalico-go/lib/errors"
 	"time"
 )
 
@@ -133,78 +134,114 @@ func ListOptionsToDefaultPathRoot(listOptions ListInterface) string {
 	return listOptions.defaultPathRoot()
 }
 
+// keyPathParser associates the default path regex of a key type with a
+// function that builds the Key from the regex submatches.
+type keyPathParser struct {
+	regex *regexp.Regexp
+	parse func(match []string) (Key, error)
+}
+
+var keyPathParsers []keyPathParser
+
+// RegisterKeyPath registers the default path regex for a key type along with a
+// function that builds the Key from the submatches of that regex.  The paths
+// matched by different key types must not overlap.  This is not thread safe
+// and should be called from an init function.
+func RegisterKeyPath(regex *regexp.Regexp, parse func(match []string) (Key, error)) {
+	keyPathParsers = append(keyPathParsers, keyPathParser{regex: regex, parse: parse})
+}
+
 // KeyFromDefaultPath parses the default path representation of a key into one
-// of our <Type>Key structs.  Returns nil if the string doesn't match one of
-// our key types.
-func KeyFromDefaultPath(path string) Key {
+// of our <Type>Key structs, using the key types registered with
+// RegisterKeyPath.  Returns an ErrorUnrecognizedPath if the string doesn't
+// match one of the registered key types.
+func KeyFromDefaultPath(path string) (Key, error) {
 	glog.V(4).Infof("Parsing key %v", path)
-	if m := matchWorkloadEndpoint.FindStringSubmatch(path); m != nil {
-		glog.V(5).Infof("Workload endpoint")
-		return WorkloadEndpointKey{
-			Hostname:       m[1],
-			OrchestratorID: m[2],
-			WorkloadID:     m[3],
-			EndpointID:     m[4],
-		}
-	} else if m := matchHostEndpoint.FindStringSubmatch(path); m != nil {
-		glog.V(5).Infof("Host endpoint")
-		return HostEndpointKey{
-			Hostname:   m[1],
-			EndpointID: m[2],
-		}
-	} else if m := matchPolicy.FindStringSubmatch(path); m != nil {
-		glog.V(5).Infof("Policy")
-		return PolicyKey{
-			Tier: m[1],
-			Name: m[2],
+	for _, p := range keyPathParsers {
+		if m := p.regex.FindStringSubmatch(path); m != nil {
+			glog.V(5).Infof("Matched %v: %v", p.regex, m)
+			return p.parse(m)
 		}
-	} else if m := matchProfile.FindStringSubmatch(path); m != nil {
-		glog.V(5).Infof("Profile %v", m)
-		pk := ProfileKey{m[1]}
-		switch m[2] {
-		case "tags":
-			glog.V(5).Infof("Profile tags")
-			return ProfileTagsKey{ProfileKey: pk}
-		case "rules":
-			glog.V(5).Infof("Profile rules")
-			return ProfileRulesKey{ProfileKey: pk}
-		case "labels":
-			glog.V(5).Infof("Profile labels")
-			return ProfileLabelsKey{ProfileKey: pk}
+	}
+	// Not a key we know about.
+	return nil, errors.ErrorUnrecognizedPath{Path: path}
+}
+
+// checkPathSegments returns an errors.ErrorValidation listing any of the
+// named values, each of which is to be used as a single segment of a key
+// path, that contain a "/" and so could not be parsed back from the path, or
+// that are "." or "..", which the datastore would resolve to a parent
+// directory.  Empty values are ignored.
+func checkPathSegments(names []string, values ...string) error {
+	verr := errors.ErrorValidation{}
+	for i, value := range values {
+		if strings.Contains(value, "/") || isDotSegment(value) {
+			verr.ErrFields = append(verr.ErrFields, errors.ErroredField{Name: names[i], Value: value})
 		}
-		return nil
-	} else if m := matchTier.FindStringSubmatch(path); m != nil {
-		glog.V(5).Infof("Policy tier")
-		return TierKey{Name: m[1]}
-	} else if m := matchHostIp.FindStringSubmatch(path); m != nil {
-		glog.V(5).Infof("Host ID")
-		return HostIPKey{Hostname: m[1]}
-	} else if m := matchPool.FindStringSubmatch(path); m != nil {
-		glog.V(5).Infof("Pool")
-		mungedCIDR := m[1]
-		cidr := strings.Replace(mungedCIDR, "-", "/", 1)
-		_, c, err := net.ParseCIDR(cidr)
-		if err != nil {
-			panic(err)
+	}
+	if len(verr.ErrFields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// nameRegex matches the names accepted by the validator's "name" rule.
+var nameRegex = regexp.MustCompile("^[a-zA-Z0-9_.-]+$")
+
+// checkNameSegments is like checkPathSegments but requires each non-empty
+// value to be a valid name, as for the validator's "name" rule.  The name
+// regex allows dots, so "." and ".." are rejected separately.
+func checkNameSegments(names []string, values ...string) error {
+	verr := errors.ErrorValidation{}
+	for i, value := range values {
+		if value != "" && (!nameRegex.MatchString(value) || isDotSegment(value)) {
+			verr.ErrFields = append(verr.ErrFields, errors.ErroredField{Name: names[i], Value: value})
 		}
-		return PoolKey{CIDR: *c}
-	} else if m := matchGlobalConfig.FindStringSubmatch(path); m != nil {
-		return GlobalConfigKey{Name: m[1]}
-	} else if m := matchHostConfig.FindStringSubmatch(path); m != nil {
-		return HostConfigKey{Hostname: m[1], Name: m[2]}
-	} else if matchReadyFlag.MatchString(path) {
-		return ReadyFlagKey{}
 	}
-	// Not a key we know about.
+	if len(verr.ErrFields) > 0 {
+		return verr
+	}
 	return nil
 }
 
+// isDotSegment returns true if the value is "." or "..", which would refer to
+// the current or parent directory if used as a path segment.
+func isDotSegment(value string) bool {
+	return value == "." || value == ".."
+}
+
+// ValueParser parses the raw datastore value of the given key into the typed
+// value returned by ParseValue.
+type ValueParser func(key Key, rawData []byte) (interface{}, error)
+
+var valueParsers = map[reflect.Type]ValueParser{}
+
+// RegisterValueParser registers the parser that ParseValue uses for keys of
+// the same concrete type as key, in place of the default JSON decoding into
+// the key's value type.  This allows additional resource types to be decoded
+// without changing ParseValue.  This is not thread safe and should be called
+// from an init function.
+func RegisterValueParser(key Key, parse ValueParser) {
+	valueParsers[reflect.TypeOf(key)] = parse
+}
+
 // ParseValue parses the default JSON representation of our data into one of
 // our value structs, according to the type of key.  I.e. if passed a
 // PolicyKey as the first parameter, it will try to parse rawData into a
-// Policy struct.
+// Policy struct.  Key types registered with RegisterValueParser are parsed by
+// their registered parser.  Returns an ErrorUnrecognizedKeyType if the key
+// type has neither a parser nor a value type.
 func ParseValue(key Key, rawData []byte) (interface{}, error) {
+	if key == nil {
+		return nil, errors.ErrorUnrecognizedKeyType{Key: key}
+	}
+	if parse, ok := valueParsers[reflect.TypeOf(key)]; ok {
+		return parse(key, rawData)
+	}
 	valueType := key.valueType()
+	if valueType == nil {
+		return nil, errors.ErrorUnrecognizedKeyType{Key: key}
+	}
 	if valueType == rawStringType {
 		return string(rawData), nil
 	}
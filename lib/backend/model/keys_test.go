@@ -0,0 +1,169 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model_test
+
+import (
+	. "github.com/tigera/libcalico-go/lib/backend/model"
+
+	"fmt"
+	"regexp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tigera/libcalico-go/lib/errors"
+	"github.com/tigera/libcalico-go/lib/net"
+)
+
+// fakeKey is a key type that is registered by the tests.  It embeds a
+// PolicyKey to pick up the Key interface methods.
+type fakeKey struct {
+	PolicyKey
+	ID string
+}
+
+func init() {
+	RegisterKeyPath(regexp.MustCompile("^/?calico/test/fake/([^/]+)$"), func(m []string) (Key, error) {
+		if m[1] == "bad" {
+			return nil, fmt.Errorf("bad fake key")
+		}
+		return fakeKey{ID: m[1]}, nil
+	})
+	RegisterValueParser(fakeKey{}, func(key Key, rawData []byte) (interface{}, error) {
+		if string(rawData) == "bad" {
+			return nil, fmt.Errorf("bad fake value")
+		}
+		return &fakeValue{ID: key.(fakeKey).ID, Data: string(rawData)}, nil
+	})
+}
+
+// fakeValue is the value type decoded for a fakeKey.
+type fakeValue struct {
+	ID   string
+	Data string
+}
+
+var _, poolCIDR, _ = net.ParseCIDR("10.1.0.0/16")
+
+var keyRoundTripTests = []Key{
+	WorkloadEndpointKey{Hostname: "h", OrchestratorID: "o", WorkloadID: "w", EndpointID: "e"},
+	HostEndpointKey{Hostname: "h", EndpointID: "e"},
+	WorkloadEndpointKey{Hostname: "h-1.example.com", OrchestratorID: "k8s", WorkloadID: "ns.pod-a_b", EndpointID: "eth0:1"},
+	HostEndpointKey{Hostname: "h-1.example.com", EndpointID: "eth0.100@bond0"},
+	PolicyKey{Tier: "t", Name: "p"},
+	ProfileRulesKey{ProfileKey{Name: "p"}},
+	ProfileTagsKey{ProfileKey{Name: "p"}},
+	ProfileLabelsKey{ProfileKey{Name: "p"}},
+	TierKey{Name: "t"},
+	HostIPKey{Hostname: "h"},
+	ReadyFlagKey{},
+	PoolKey{CIDR: *poolCIDR},
+}
+
+// badPathKeys are keys with identifiers that cannot be used in a path, along
+// with the name of the offending identifier.
+var badPathKeys = []struct {
+	key       Key
+	fieldName string
+}{
+	{WorkloadEndpointKey{Hostname: "h/1", OrchestratorID: "o", WorkloadID: "w", EndpointID: "e"}, "hostname"},
+	{WorkloadEndpointKey{Hostname: "h", OrchestratorID: "o", WorkloadID: "ns/pod", EndpointID: "e"}, "workload"},
+	{WorkloadEndpointKey{Hostname: "h", OrchestratorID: "o", WorkloadID: "w", EndpointID: "/e"}, "endpointID"},
+	{HostEndpointKey{Hostname: "h/", EndpointID: "e"}, "hostname"},
+	{HostEndpointKey{Hostname: "h", EndpointID: "eth0/1"}, "name"},
+	{WorkloadEndpointKey{Hostname: "..", OrchestratorID: "o", WorkloadID: "w", EndpointID: "e"}, "hostname"},
+	{WorkloadEndpointKey{Hostname: "h", OrchestratorID: "o", WorkloadID: "..", EndpointID: "e"}, "workload"},
+	{WorkloadEndpointKey{Hostname: "h", OrchestratorID: "o", WorkloadID: "w", EndpointID: "."}, "endpointID"},
+	{HostEndpointKey{Hostname: "h", EndpointID: ".."}, "name"},
+	{PolicyKey{Tier: "t", Name: ".."}, "name"},
+	{PolicyKey{Tier: "..", Name: "p"}, "tier"},
+	{TierKey{Name: ".."}, "name"},
+	{ProfileKey{Name: "."}, "name"},
+	{ProfileRulesKey{ProfileKey{Name: ".."}}, "name"},
+}
+
+var _ = Describe("KeyFromDefaultPath", func() {
+	for _, key := range keyRoundTripTests {
+		key := key // For closure
+		It(fmt.Sprintf("should round-trip %v", key), func() {
+			path, err := KeyToDefaultPath(key)
+			Expect(err).To(BeNil())
+			parsed, err := KeyFromDefaultPath(path)
+			Expect(err).To(BeNil())
+			Expect(parsed).To(Equal(key))
+		})
+	}
+
+	It("should return an error for an unrecognized path", func() {
+		key, err := KeyFromDefaultPath("/calico/v1/unknown/foo")
+		Expect(key).To(BeNil())
+		Expect(err).To(Equal(errors.ErrorUnrecognizedPath{Path: "/calico/v1/unknown/foo"}))
+	})
+
+	It("should not parse the bare profile directory", func() {
+		// The syncer reports this path as a parse failure.
+		key, err := KeyFromDefaultPath("/calico/v1/policy/profile/p")
+		Expect(key).To(BeNil())
+		Expect(err).To(Equal(errors.ErrorUnrecognizedPath{Path: "/calico/v1/policy/profile/p"}))
+	})
+
+	It("should resolve a registered key type", func() {
+		key, err := KeyFromDefaultPath("/calico/test/fake/foo")
+		Expect(err).To(BeNil())
+		Expect(key).To(Equal(fakeKey{ID: "foo"}))
+	})
+
+	It("should return an error from a registered key type", func() {
+		key, err := KeyFromDefaultPath("/calico/test/fake/bad")
+		Expect(key).To(BeNil())
+		Expect(err).NotTo(BeNil())
+	})
+
+	for _, test := range badPathKeys {
+		test := test // For closure
+		It(fmt.Sprintf("should reject %v", test.key), func() {
+			_, err := KeyToDefaultPath(test.key)
+			Expect(err).To(BeAssignableToTypeOf(errors.ErrorValidation{}))
+			Expect(err.(errors.ErrorValidation).ErrFields[0].Name).To(Equal(test.fieldName))
+			_, err = KeyToDefaultDeletePath(test.key)
+			Expect(err).To(BeAssignableToTypeOf(errors.ErrorValidation{}))
+		})
+	}
+})
+
+var _ = Describe("ParseValue", func() {
+	It("should decode a built-in value type from JSON", func() {
+		value, err := ParseValue(PolicyKey{Tier: "t", Name: "p"}, []byte(`{"selector": "all()"}`))
+		Expect(err).To(BeNil())
+		Expect(value).To(Equal(&Policy{Selector: "all()"}))
+	})
+
+	It("should decode a registered key type with its parser", func() {
+		value, err := ParseValue(fakeKey{ID: "foo"}, []byte("some data"))
+		Expect(err).To(BeNil())
+		Expect(value).To(Equal(&fakeValue{ID: "foo", Data: "some data"}))
+	})
+
+	It("should return an error from a registered parser", func() {
+		value, err := ParseValue(fakeKey{ID: "foo"}, []byte("bad"))
+		Expect(value).To(BeNil())
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("should return an error for a nil key", func() {
+		value, err := ParseValue(nil, []byte("{}"))
+		Expect(value).To(BeNil())
+		Expect(err).To(Equal(errors.ErrorUnrecognizedKeyType{}))
+	})
+})
@@ -0,0 +1,65 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import "sort"
+
+// sortKVPairsByOrder sorts KVPairs by ascending order, as returned by order
+// for each value, with nil orders last.  Ties are broken by comparing the
+// names returned by names for each key in turn, so that the result is
+// deterministic.  names returns false for a key of an unexpected type; such
+// KVPairs sort after the others with the same order, keeping their relative
+// order.  It is shared by SortPoliciesByOrder and SortTiersByOrder.
+func sortKVPairsByOrder(kvps []*KVPair, order func(value interface{}) *float32, names func(key Key) ([]string, bool)) {
+	sort.Stable(kvPairsByOrder{kvps, order, names})
+}
+
+type kvPairsByOrder struct {
+	kvps  []*KVPair
+	order func(value interface{}) *float32
+	names func(key Key) ([]string, bool)
+}
+
+func (p kvPairsByOrder) Len() int {
+	return len(p.kvps)
+}
+
+func (p kvPairsByOrder) Swap(i, j int) {
+	p.kvps[i], p.kvps[j] = p.kvps[j], p.kvps[i]
+}
+
+func (p kvPairsByOrder) Less(i, j int) bool {
+	orderI := p.order(p.kvps[i].Value)
+	orderJ := p.order(p.kvps[j].Value)
+	switch {
+	case orderI == nil && orderJ != nil:
+		return false
+	case orderI != nil && orderJ == nil:
+		return true
+	case orderI != nil && orderJ != nil && *orderI != *orderJ:
+		return *orderI < *orderJ
+	}
+	namesI, okI := p.names(p.kvps[i].Key)
+	namesJ, okJ := p.names(p.kvps[j].Key)
+	if !okI || !okJ {
+		return okI && !okJ
+	}
+	for k := range namesI {
+		if namesI[k] != namesJ[k] {
+			return namesI[k] < namesJ[k]
+		}
+	}
+	return false
+}
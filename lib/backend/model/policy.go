@@ -15,15 +15,18 @@
 package model
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
 
 	"reflect"
 
+	"sort"
 	"strings"
 
 	"github.com/golang/glog"
 	"github.com/tigera/libcalico-go/lib/errors"
+	"github.com/tigera/libcalico-go/lib/hash"
 )
 
 var (
@@ -31,20 +34,31 @@ var (
 	typePolicy  = reflect.TypeOf(Policy{})
 )
 
+func init() {
+	RegisterKeyPath(matchPolicy, func(m []string) (Key, error) {
+		return PolicyKey{
+			Tier: m[1],
+			Name: m[2],
+		}, nil
+	})
+}
+
+// PolicyKey identifies a policy within a tier.  An empty Tier refers to the
+// default tier.
 type PolicyKey struct {
 	Name string `json:"-" validate:"required,name"`
-	Tier string `json:"-" validate:"required,name"`
+	Tier string `json:"-" validate:"omitempty,name"`
 }
 
 func (key PolicyKey) defaultPath() (string, error) {
-	if key.Tier == "" {
-		return "", errors.ErrorInsufficientIdentifiers{Name: "tier"}
-	}
 	if key.Name == "" {
 		return "", errors.ErrorInsufficientIdentifiers{Name: "name"}
 	}
+	if err := checkNameSegments([]string{"name", "tier"}, key.Name, key.Tier); err != nil {
+		return "", err
+	}
 	e := fmt.Sprintf("/calico/v1/policy/tier/%s/policy/%s",
-		key.Tier, key.Name)
+		tierOrDefault(key.Tier), key.Name)
 	return e, nil
 }
 
@@ -60,17 +74,29 @@ func (key PolicyKey) String() string {
 	return fmt.Sprintf("Policy(tier=%s, name=%s)", key.Tier, key.Name)
 }
 
+// PolicyListOptions lists policies.  If neither Name nor Tier is specified,
+// policies in all tiers are listed; a Name without a Tier refers to the
+// default tier, as for PolicyKey.
 type PolicyListOptions struct {
 	Name string
 	Tier string
 }
 
+// tier returns the tier to list, or "" to list all tiers.
+func (options PolicyListOptions) tier() string {
+	if options.Name != "" {
+		return tierOrDefault(options.Tier)
+	}
+	return options.Tier
+}
+
 func (options PolicyListOptions) defaultPathRoot() string {
 	k := "/calico/v1/policy/tier"
-	if options.Tier == "" {
+	tier := options.tier()
+	if tier == "" {
 		return k
 	}
-	k = k + fmt.Sprintf("/%s/policy", options.Tier)
+	k = k + fmt.Sprintf("/%s/policy", tier)
 	if options.Name == "" {
 		return k
 	}
@@ -78,6 +104,28 @@ func (options PolicyListOptions) defaultPathRoot() string {
 	return k
 }
 
+// DeletePathRoot returns the datastore path prefix under which all of the
+// policies in the tier are stored, so that a backend can delete the whole
+// tier's policies with a single recursive delete.  The prefix ends with a
+// "/", so it does not match the policies of a tier whose name merely starts
+// with this tier's name.  The Tier must be given explicitly, rather than
+// defaulted, and Name must not be set, so that a badly formed options struct
+// cannot delete more, or less, than the caller intended.
+func (options PolicyListOptions) DeletePathRoot() (string, error) {
+	if options.Tier == "" {
+		return "", errors.ErrorInsufficientIdentifiers{Name: "tier"}
+	}
+	if options.Name != "" {
+		return "", errors.ErrorValidation{ErrFields: []errors.ErroredField{
+			{Name: "name", Value: options.Name},
+		}}
+	}
+	if err := checkNameSegments([]string{"tier"}, options.Tier); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("/calico/v1/policy/tier/%s/policy/", options.Tier), nil
+}
+
 func (options PolicyListOptions) KeyFromDefaultPath(path string) Key {
 	glog.V(2).Infof("Get Policy key from %s", path)
 	r := matchPolicy.FindAllStringSubmatch(path, -1)
@@ -87,8 +135,8 @@ func (options PolicyListOptions) KeyFromDefaultPath(path string) Key {
 	}
 	tier := r[0][1]
 	name := r[0][2]
-	if options.Tier != "" && tier != options.Tier {
-		glog.V(2).Infof("Didn't match tier %s != %s", options.Tier, tier)
+	if options.tier() != "" && tier != options.tier() {
+		glog.V(2).Infof("Didn't match tier %s != %s", options.tier(), tier)
 		return nil
 	}
 	if options.Name != "" && name != options.Name {
@@ -98,11 +146,19 @@ func (options PolicyListOptions) KeyFromDefaultPath(path string) Key {
 	return PolicyKey{Tier: tier, Name: name}
 }
 
+// tierOrDefault returns the tier name, or the default tier name if blank.
+func tierOrDefault(tier string) string {
+	if tier == "" {
+		return DefaultTierName
+	}
+	return tier
+}
+
 type Policy struct {
 	Order         *float32 `json:"order,omitempty" validate:"omitempty"`
 	InboundRules  []Rule   `json:"inbound_rules,omitempty" validate:"omitempty,dive"`
 	OutboundRules []Rule   `json:"outbound_rules,omitempty" validate:"omitempty,dive"`
-	Selector      string   `json:"selector" validate:"selector"`
+	Selector      string   `json:"selector" validate:"backendselector"`
 }
 
 func (p Policy) String() string {
@@ -123,3 +179,176 @@ func (p Policy) String() string {
 	parts = append(parts, fmt.Sprintf("outbound:%v", strings.Join(outRules, ";")))
 	return strings.Join(parts, ",")
 }
+
+// SortPoliciesByOrder sorts a list of policy KVPairs (each with a PolicyKey
+// and a Policy or *Policy value, as returned when listing with
+// PolicyListOptions) into the order in which they should be applied.
+// Policies are sorted by ascending Order, with policies that have a nil Order
+// last.  Ties are broken by policy name and then tier name, so the result is
+// deterministic.  Values of other types are treated as having a nil Order,
+// and KVPairs with other key types sort after the policies with the same
+// order.
+func SortPoliciesByOrder(policies []*KVPair) {
+	sortKVPairsByOrder(policies, policyOrder, policyNames)
+}
+
+// policyNames returns the policy name and then tier name, which break ties in
+// SortPoliciesByOrder, or false if the key is not a PolicyKey.
+func policyNames(key Key) ([]string, bool) {
+	k, ok := key.(PolicyKey)
+	return []string{k.Name, k.Tier}, ok
+}
+
+func policyOrder(value interface{}) *float32 {
+	switch policy := value.(type) {
+	case Policy:
+		return policy.Order
+	case *Policy:
+		if policy != nil {
+			return policy.Order
+		}
+	}
+	return nil
+}
+
+// DeepCopy returns a copy of the policy that shares no mutable state with the
+// original, so that the copy may be handed to code that modifies it.
+func (p Policy) DeepCopy() Policy {
+	c := p
+	if p.Order != nil {
+		order := *p.Order
+		c.Order = &order
+	}
+	c.InboundRules = copyRules(p.InboundRules)
+	c.OutboundRules = copyRules(p.OutboundRules)
+	return c
+}
+
+// RulesForIPVersion returns the policy's inbound and outbound rules that
+// apply to the given IP version (4 or 6), as Rule.AppliesToIPVersion.  Rules
+// with no explicit IP version or CIDRs apply to both versions.
+func (p Policy) RulesForIPVersion(version int) (inbound, outbound []Rule) {
+	return filterRulesByIPVersion(p.InboundRules, version),
+		filterRulesByIPVersion(p.OutboundRules, version)
+}
+
+func filterRulesByIPVersion(rules []Rule, version int) []Rule {
+	filtered := []Rule{}
+	for _, rule := range rules {
+		if rule.AppliesToIPVersion(version) {
+			filtered = append(filtered, rule)
+		}
+	}
+	return filtered
+}
+
+// ContentHash returns a hash of the policy's content that changes only if the
+// policy does.  The policy's selector and rules are canonicalised first, as
+// Rule.Canonicalize, so, for example, equivalent spellings of a selector hash
+// the same.  Rule order is significant, since rules are evaluated in order,
+// so reordering the rules changes the hash.  An error is returned if the
+// policy cannot be serialised, for example because a rule has a port with an
+// invalid type.
+func (p Policy) ContentHash() (string, error) {
+	c := p
+	c.Selector = canonicalSelector(p.Selector)
+	c.InboundRules = canonicalRules(p.InboundRules)
+	c.OutboundRules = canonicalRules(p.OutboundRules)
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return hash.MakeUniqueID("p", string(data)), nil
+}
+
+// MaxPolicyRules is the maximum number of inbound rules, and separately of
+// outbound rules, that Policy.Validate accepts in a policy.  Very large
+// policies are expensive for Felix to render.  A value of zero or less removes
+// the limit.  This is not thread safe and should be set during initialisation.
+var MaxPolicyRules = 1000
+
+// Validate checks that the policy's selector passes ValidateSelector, that it
+// has no more than MaxPolicyRules inbound or outbound rules and that each of
+// its rules passes Rule.Validate.  The returned error is an
+// errors.ErrorValidation listing every offending field; rule fields are
+// named after the rule, for example "inbound_rules[0].src_ports".
+func (p Policy) Validate() error {
+	verr := errors.ErrorValidation{}
+	if err := ValidateSelector(p.Selector); err != nil {
+		verr.ErrFields = append(verr.ErrFields, errors.ErroredField{Name: "selector", Value: p.Selector})
+	}
+	for _, f := range []struct {
+		name  string
+		rules []Rule
+	}{
+		{"inbound_rules", p.InboundRules},
+		{"outbound_rules", p.OutboundRules},
+	} {
+		if MaxPolicyRules > 0 && len(f.rules) > MaxPolicyRules {
+			verr.ErrFields = append(verr.ErrFields, errors.ErroredField{
+				Name:  f.name,
+				Value: fmt.Sprintf("%d rules, more than the maximum of %d", len(f.rules), MaxPolicyRules),
+			})
+		}
+	}
+	verr.ErrFields = appendRuleErrors(verr.ErrFields, "inbound_rules", p.InboundRules)
+	verr.ErrFields = appendRuleErrors(verr.ErrFields, "outbound_rules", p.OutboundRules)
+
+	if len(verr.ErrFields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// appendRuleErrors validates each of the rules and appends the offending
+// fields, named after the rule, for example "inbound_rules[0].src_ports".
+func appendRuleErrors(fields []errors.ErroredField, name string, rules []Rule) []errors.ErroredField {
+	for i, rule := range rules {
+		err := rule.Validate()
+		if err == nil {
+			continue
+		}
+		for _, field := range err.(errors.ErrorValidation).ErrFields {
+			field.Name = fmt.Sprintf("%s[%d].%s", name, i, field.Name)
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// ValidatePolicies validates each of the policies, as Policy.Validate, and
+// returns an errors.ErrorResourceInvalid, identifying the PolicyKey, for each
+// invalid policy.  The errors are ordered by key.  An empty result means that
+// all of the policies are valid.
+func ValidatePolicies(policies map[PolicyKey]Policy) []error {
+	keys := make([]PolicyKey, 0, len(policies))
+	for key := range policies {
+		keys = append(keys, key)
+	}
+	sort.Sort(policyKeys(keys))
+
+	errs := []error{}
+	for _, key := range keys {
+		if err := policies[key].Validate(); err != nil {
+			errs = append(errs, errors.ErrorResourceInvalid{Err: err, Identifier: key})
+		}
+	}
+	return errs
+}
+
+type policyKeys []PolicyKey
+
+func (k policyKeys) Len() int {
+	return len(k)
+}
+
+func (k policyKeys) Swap(i, j int) {
+	k[i], k[j] = k[j], k[i]
+}
+
+func (k policyKeys) Less(i, j int) bool {
+	if k[i].Tier != k[j].Tier {
+		return k[i].Tier < k[j].Tier
+	}
+	return k[i].Name < k[j].Name
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import "reflect"
+
+// Compact returns a copy of the policy in which adjacent rules that can be
+// merged without changing the policy's behaviour have been merged, preserving
+// the order of the remaining rules.  Merging is deliberately conservative: a
+// rule that is identical to the rule before it is dropped, and adjacent rules
+// that differ only in their (non-empty) src_ports, or only in their
+// (non-empty) dst_ports, are merged into one rule that matches either list of
+// ports.  Log rules are never merged, since a packet that matches both rules
+// would be logged twice.
+func (p Policy) Compact() Policy {
+	c := p.DeepCopy()
+	c.InboundRules = compactRules(c.InboundRules)
+	c.OutboundRules = compactRules(c.OutboundRules)
+	return c
+}
+
+func compactRules(rules []Rule) []Rule {
+	if rules == nil {
+		return nil
+	}
+	compacted := make([]Rule, 0, len(rules))
+	for _, rule := range rules {
+		if last := len(compacted) - 1; last >= 0 {
+			if merged, ok := mergeRules(compacted[last], rule); ok {
+				compacted[last] = merged
+				continue
+			}
+		}
+		compacted = append(compacted, rule)
+	}
+	return compacted
+}
+
+// mergeRules returns a single rule equivalent to rule a followed by rule b,
+// if there is one that Compact can find.
+func mergeRules(a, b Rule) (Rule, bool) {
+	if a.Action == ActionLog {
+		return Rule{}, false
+	}
+	if reflect.DeepEqual(a, b) {
+		return a, true
+	}
+
+	// A port list matches any of its ports, so two rules that differ only
+	// in a positive port match are equivalent to one rule with both lists.
+	// Empty lists match any port so they can't be merged this way, and nor
+	// can negated lists, since "not in A or not in B" is not "not in A+B".
+	bWithSrcPorts := b
+	bWithSrcPorts.SrcPorts = a.SrcPorts
+	if len(a.SrcPorts) > 0 && len(b.SrcPorts) > 0 && reflect.DeepEqual(a, bWithSrcPorts) {
+		merged := a
+		merged.SrcPorts = append(copyPorts(a.SrcPorts), b.SrcPorts...)
+		return merged, true
+	}
+	bWithDstPorts := b
+	bWithDstPorts.DstPorts = a.DstPorts
+	if len(a.DstPorts) > 0 && len(b.DstPorts) > 0 && reflect.DeepEqual(a, bWithDstPorts) {
+		merged := a
+		merged.DstPorts = append(copyPorts(a.DstPorts), b.DstPorts...)
+		return merged, true
+	}
+	return Rule{}, false
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import "reflect"
+
+// PolicyDiff describes how one policy differs from another, as computed by
+// Policy.Diff.
+type PolicyDiff struct {
+	SelectorChanged bool
+	OrderChanged    bool
+	InboundRules    RulesDiff
+	OutboundRules   RulesDiff
+}
+
+// IsEmpty returns true if the two policies were identical.
+func (d PolicyDiff) IsEmpty() bool {
+	return !d.SelectorChanged && !d.OrderChanged &&
+		d.InboundRules.IsEmpty() && d.OutboundRules.IsEmpty()
+}
+
+// RulesDiff describes how a list of rules changed.  Rules are identified by
+// their content, so a rule that appears in both lists, at any position, is
+// treated as the same rule.
+//
+// Indexes in Added refer to the new list and those in Removed to the old
+// list.  Modified lists indexes at which an unmatched old rule was replaced
+// by an unmatched new rule.  Moved lists rules that appear in both lists but
+// at different indexes.
+type RulesDiff struct {
+	Added    []int
+	Removed  []int
+	Modified []int
+	Moved    []RuleMove
+}
+
+// RuleMove records that the rule at OldIndex in the old list is at NewIndex
+// in the new list.
+type RuleMove struct {
+	OldIndex int
+	NewIndex int
+}
+
+// IsEmpty returns true if the two rule lists were identical.
+func (d RulesDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 &&
+		len(d.Modified) == 0 && len(d.Moved) == 0
+}
+
+// Diff returns the changes needed to turn the policy p into other.
+func (p Policy) Diff(other Policy) PolicyDiff {
+	return PolicyDiff{
+		SelectorChanged: p.Selector != other.Selector,
+		OrderChanged:    !ordersEqual(p.Order, other.Order),
+		InboundRules:    diffRules(p.InboundRules, other.InboundRules),
+		OutboundRules:   diffRules(p.OutboundRules, other.OutboundRules),
+	}
+}
+
+func ordersEqual(a, b *float32) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+func diffRules(oldRules, newRules []Rule) RulesDiff {
+	diff := RulesDiff{}
+
+	// Pair up identical rules, matching each new rule with the first
+	// unpaired old rule that is equal to it.
+	oldMatched := make([]bool, len(oldRules))
+	newMatched := make([]bool, len(newRules))
+	for newIdx, newRule := range newRules {
+		for oldIdx, oldRule := range oldRules {
+			if oldMatched[oldIdx] || !reflect.DeepEqual(oldRule, newRule) {
+				continue
+			}
+			oldMatched[oldIdx] = true
+			newMatched[newIdx] = true
+			if oldIdx != newIdx {
+				diff.Moved = append(diff.Moved, RuleMove{OldIndex: oldIdx, NewIndex: newIdx})
+			}
+			break
+		}
+	}
+
+	// An unpaired rule at an index that also has an unpaired rule in the
+	// other list was modified in place; any others were added or removed.
+	for oldIdx := range oldRules {
+		if oldMatched[oldIdx] {
+			continue
+		}
+		if oldIdx < len(newRules) && !newMatched[oldIdx] {
+			diff.Modified = append(diff.Modified, oldIdx)
+			newMatched[oldIdx] = true
+		} else {
+			diff.Removed = append(diff.Removed, oldIdx)
+		}
+	}
+	for newIdx := range newRules {
+		if !newMatched[newIdx] {
+			diff.Added = append(diff.Added, newIdx)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import "github.com/tigera/libcalico-go/lib/selector"
+
+// The directions of traffic understood by EvaluatePolicyChain.
+const (
+	DirectionInbound  = "inbound"
+	DirectionOutbound = "outbound"
+)
+
+// EvaluatePolicyChain evaluates the rules of the given tiers of policies for
+// traffic in the given direction to or from a peer whose labels are looked up
+// with getLabel.  Each element of tiers holds the policies in one tier that
+// apply to the endpoint; the tiers and the policies within each tier should
+// already be sorted into evaluation order.  For inbound traffic the peer is
+// the source, so each rule's SrcSelector and NotSrcSelector are evaluated;
+// for outbound traffic the peer is the destination.
+//
+// Within a tier, the first allow or deny rule that matches resolves the chain
+// and its action is returned, with matched true.  A matching log rule does
+// not end evaluation.  A matching next-tier rule passes: the rest of the tier
+// is skipped and evaluation continues with the next tier.  If the end of a
+// tier is reached without a match, the traffic is denied, so an empty tier is
+// the only kind that is skipped without a pass.  If every tier passes, or the
+// direction is not known, EvaluatePolicyChain returns "" and false, leaving
+// the decision to the endpoint's profiles.
+//
+// Only labels are known, so rules with any other match criteria, such as
+// nets, ports or tags, are treated as not matching, as are rules with
+// selectors that fail to parse.
+func EvaluatePolicyChain(tiers [][]Policy, direction string, getLabel func(string) (string, bool)) (action string, matched bool) {
+	if direction != DirectionInbound && direction != DirectionOutbound {
+		return "", false
+	}
+tiers:
+	for _, policies := range tiers {
+		if len(policies) == 0 {
+			continue
+		}
+		for _, p := range policies {
+			rules := p.InboundRules
+			if direction == DirectionOutbound {
+				rules = p.OutboundRules
+			}
+			for _, r := range rules {
+				if !r.matchesPeerLabels(direction, getLabel) {
+					continue
+				}
+				switch r.Action {
+				case ActionLog:
+					continue
+				case ActionNextTier:
+					continue tiers
+				case "":
+					return ActionAllow, true
+				default:
+					return r.Action, true
+				}
+			}
+		}
+		// No policy in the tier matched.
+		return ActionDeny, true
+	}
+	return "", false
+}
+
+// matchesPeerLabels returns true if the rule matches a peer with the given
+// labels, as described for EvaluatePolicyChain.
+func (r Rule) matchesPeerLabels(direction string, getLabel func(string) (string, bool)) bool {
+	peer := r
+	if direction == DirectionInbound {
+		peer.SrcSelector, peer.NotSrcSelector = "", ""
+	} else {
+		peer.DstSelector, peer.NotDstSelector = "", ""
+	}
+	if peer.hasMatchCriteria() {
+		// The rule matches on something other than the peer's labels.
+		return false
+	}
+	sel, notSel := r.SrcSelector, r.NotSrcSelector
+	if direction == DirectionOutbound {
+		sel, notSel = r.DstSelector, r.NotDstSelector
+	}
+	if sel != "" {
+		s, err := selector.Parse(sel)
+		if err != nil || !s.EvaluateFunc(getLabel) {
+			return false
+		}
+	}
+	if notSel != "" {
+		s, err := selector.Parse(notSel)
+		if err != nil || s.EvaluateFunc(getLabel) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasMatchCriteria returns true if the rule matches on anything, as opposed
+// to matching all traffic.
+func (r Rule) hasMatchCriteria() bool {
+	return !(r.IPVersion == nil &&
+		r.Protocol == nil && r.NotProtocol == nil &&
+		r.ICMPType == nil && r.ICMPCode == nil &&
+		r.NotICMPType == nil && r.NotICMPCode == nil &&
+		r.SrcTag == "" && r.SrcNet == nil && r.SrcSelector == "" && len(r.SrcPorts) == 0 &&
+		r.DstTag == "" && r.DstNet == nil && r.DstSelector == "" && len(r.DstPorts) == 0 &&
+		r.NotSrcTag == "" && r.NotSrcNet == nil && r.NotSrcSelector == "" && len(r.NotSrcPorts) == 0 &&
+		r.NotDstTag == "" && r.NotDstNet == nil && r.NotDstSelector == "" && len(r.NotDstPorts) == 0)
+}
@@ -0,0 +1,760 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model_test
+
+import (
+	. "github.com/tigera/libcalico-go/lib/backend/model"
+
+	"fmt"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tigera/libcalico-go/lib/errors"
+	"github.com/tigera/libcalico-go/lib/numorstring"
+)
+
+var _ = Describe("Policy DeepCopy", func() {
+	var policy Policy
+
+	BeforeEach(func() {
+		order := float32(10)
+		policy = Policy{
+			Order:         &order,
+			Selector:      `a == "b"`,
+			InboundRules:  []Rule{{Action: "allow", SrcPorts: ports}},
+			OutboundRules: []Rule{{Action: "deny", DstNet: cidr}},
+		}
+	})
+
+	It("should produce an equal policy", func() {
+		Expect(policy.DeepCopy()).To(Equal(policy))
+	})
+
+	It("should not be affected by changes to the copy", func() {
+		original := policy.String()
+		c := policy.DeepCopy()
+		*c.Order = 20
+		c.InboundRules[0].Action = "deny"
+		c.InboundRules[0].SrcPorts[0] = numorstring.PortFromInt(1)
+		c.OutboundRules[0].DstNet.IP[0] = 11
+		c.OutboundRules = append(c.OutboundRules, Rule{})
+		Expect(policy.String()).To(Equal(original))
+		Expect(policy.OutboundRules).To(HaveLen(1))
+	})
+
+	It("should preserve nil rule slices", func() {
+		c := Policy{Selector: "all()"}.DeepCopy()
+		Expect(c.InboundRules).To(BeNil())
+		Expect(c.OutboundRules).To(BeNil())
+	})
+})
+
+var _ = Describe("PolicyKey with the default tier", func() {
+	const defaultPath = "/calico/v1/policy/tier/default/policy/p"
+
+	It("should map an empty tier to the default tier", func() {
+		path, err := KeyToDefaultPath(PolicyKey{Name: "p"})
+		Expect(err).To(BeNil())
+		Expect(path).To(Equal(defaultPath))
+		deletePath, err := KeyToDefaultDeletePath(PolicyKey{Name: "p"})
+		Expect(err).To(BeNil())
+		Expect(deletePath).To(Equal(defaultPath))
+	})
+
+	It("should round-trip a policy without an explicit tier", func() {
+		path, err := KeyToDefaultPath(PolicyKey{Name: "p"})
+		Expect(err).To(BeNil())
+		key, err := KeyFromDefaultPath(path)
+		Expect(err).To(BeNil())
+		Expect(key).To(Equal(PolicyKey{Tier: DefaultTierName, Name: "p"}))
+		path2, err := KeyToDefaultPath(key)
+		Expect(err).To(BeNil())
+		Expect(path2).To(Equal(path))
+	})
+
+	It("should still require a name", func() {
+		_, err := KeyToDefaultPath(PolicyKey{Tier: "t"})
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("should list policies without a tier when listing the default tier", func() {
+		l := PolicyListOptions{Tier: DefaultTierName}
+		Expect(ListOptionsToDefaultPathRoot(l)).To(Equal("/calico/v1/policy/tier/default/policy"))
+		Expect(l.KeyFromDefaultPath(defaultPath)).To(Equal(PolicyKey{Tier: DefaultTierName, Name: "p"}))
+	})
+
+	It("should look up a named policy without a tier in the default tier", func() {
+		l := PolicyListOptions{Name: "p"}
+		Expect(ListOptionsToDefaultPathRoot(l)).To(Equal(defaultPath))
+		Expect(l.KeyFromDefaultPath(defaultPath)).To(Equal(PolicyKey{Tier: DefaultTierName, Name: "p"}))
+		Expect(l.KeyFromDefaultPath("/calico/v1/policy/tier/t/policy/p")).To(BeNil())
+	})
+
+	It("should list all tiers if neither name nor tier is specified", func() {
+		l := PolicyListOptions{}
+		Expect(ListOptionsToDefaultPathRoot(l)).To(Equal("/calico/v1/policy/tier"))
+		Expect(l.KeyFromDefaultPath("/calico/v1/policy/tier/t/policy/p")).To(Equal(PolicyKey{Tier: "t", Name: "p"}))
+		Expect(l.KeyFromDefaultPath(defaultPath)).To(Equal(PolicyKey{Tier: DefaultTierName, Name: "p"}))
+	})
+})
+
+var invalidPolicyKeys = []struct {
+	key        PolicyKey
+	fieldName  string
+	fieldValue string
+}{
+	{PolicyKey{Tier: "t", Name: "a/b"}, "name", "a/b"},
+	{PolicyKey{Name: "../p"}, "name", "../p"},
+	{PolicyKey{Tier: "t", Name: "p q"}, "name", "p q"},
+	{PolicyKey{Tier: "t", Name: "p*"}, "name", "p*"},
+	{PolicyKey{Tier: "t/u", Name: "p"}, "tier", "t/u"},
+	{PolicyKey{Tier: "t%2F", Name: "p"}, "tier", "t%2F"},
+	{PolicyKey{Tier: "t", Name: ".."}, "name", ".."},
+	{PolicyKey{Tier: "t", Name: "."}, "name", "."},
+	{PolicyKey{Tier: "..", Name: "p"}, "tier", ".."},
+	{PolicyKey{Tier: ".", Name: "p"}, "tier", "."},
+}
+
+var _ = Describe("PolicyKey path segments", func() {
+	for _, test := range invalidPolicyKeys {
+		test := test // For closure
+		It(fmt.Sprintf("should reject %v", test.key), func() {
+			_, err := KeyToDefaultPath(test.key)
+			Expect(err).To(Equal(errors.ErrorValidation{ErrFields: []errors.ErroredField{
+				{Name: test.fieldName, Value: test.fieldValue},
+			}}))
+			_, err = KeyToDefaultDeletePath(test.key)
+			Expect(err).NotTo(BeNil())
+		})
+	}
+
+	It("should accept and round-trip names with dots, dashes and underscores", func() {
+		key := PolicyKey{Tier: "tier_1.a", Name: "k8s.ns-1_policy"}
+		path, err := KeyToDefaultPath(key)
+		Expect(err).To(BeNil())
+		Expect(KeyFromDefaultPath(path)).To(Equal(key))
+	})
+})
+
+var _ = Describe("PolicyListOptions DeletePathRoot", func() {
+	It("should return a prefix that matches exactly the tier's policies", func() {
+		root, err := PolicyListOptions{Tier: "t"}.DeletePathRoot()
+		Expect(err).To(BeNil())
+		Expect(root).To(Equal("/calico/v1/policy/tier/t/policy/"))
+
+		for _, key := range []PolicyKey{
+			{Tier: "t", Name: "p"},
+			{Tier: "t", Name: "t"},
+			{Tier: "t", Name: "policy"},
+		} {
+			path, err := KeyToDefaultPath(key)
+			Expect(err).To(BeNil())
+			Expect(strings.HasPrefix(path, root)).To(BeTrue(), path)
+		}
+		for _, key := range []Key{
+			PolicyKey{Tier: "t2", Name: "p"},
+			PolicyKey{Tier: "tt", Name: "p"},
+			PolicyKey{Name: "p"},
+			TierKey{Name: "t"},
+		} {
+			path, err := KeyToDefaultPath(key)
+			Expect(err).To(BeNil())
+			Expect(strings.HasPrefix(path, root)).To(BeFalse(), path)
+		}
+	})
+
+	It("should return the default tier's prefix only if asked for explicitly", func() {
+		root, err := PolicyListOptions{Tier: DefaultTierName}.DeletePathRoot()
+		Expect(err).To(BeNil())
+		Expect(root).To(Equal("/calico/v1/policy/tier/default/policy/"))
+	})
+
+	It("should require a tier", func() {
+		_, err := PolicyListOptions{}.DeletePathRoot()
+		Expect(err).To(Equal(errors.ErrorInsufficientIdentifiers{Name: "tier"}))
+	})
+
+	It("should reject a name", func() {
+		_, err := PolicyListOptions{Tier: "t", Name: "p"}.DeletePathRoot()
+		Expect(err).To(Equal(errors.ErrorValidation{ErrFields: []errors.ErroredField{
+			{Name: "name", Value: "p"},
+		}}))
+	})
+
+	It("should reject a tier that is not a single path segment", func() {
+		for _, tier := range []string{"t/u", ".", "..", "t%2F", "*"} {
+			_, err := PolicyListOptions{Tier: tier}.DeletePathRoot()
+			Expect(err).To(Equal(errors.ErrorValidation{ErrFields: []errors.ErroredField{
+				{Name: "tier", Value: tier},
+			}}), tier)
+		}
+	})
+})
+
+// policyKVP returns a policy KVPair with the given name and order.
+func policyKVP(name string, order *float32) *KVPair {
+	return &KVPair{
+		Key:   PolicyKey{Tier: "t", Name: name},
+		Value: Policy{Order: order, Selector: "all()"},
+	}
+}
+
+func orderPtr(order float32) *float32 {
+	return &order
+}
+
+var _ = Describe("SortPoliciesByOrder", func() {
+	names := func(kvps []*KVPair) []string {
+		n := []string{}
+		for _, kvp := range kvps {
+			n = append(n, kvp.Key.(PolicyKey).Name)
+		}
+		return n
+	}
+
+	It("should sort by order with nil orders last", func() {
+		kvps := []*KVPair{
+			policyKVP("nil1", nil),
+			policyKVP("ten", orderPtr(10)),
+			policyKVP("minus", orderPtr(-1)),
+			policyKVP("one", orderPtr(1)),
+		}
+		SortPoliciesByOrder(kvps)
+		Expect(names(kvps)).To(Equal([]string{"minus", "one", "ten", "nil1"}))
+	})
+
+	It("should break ties on name", func() {
+		kvps := []*KVPair{
+			policyKVP("c", orderPtr(5)),
+			policyKVP("z", nil),
+			policyKVP("b", orderPtr(5)),
+			policyKVP("y", nil),
+			policyKVP("a", orderPtr(5)),
+		}
+		SortPoliciesByOrder(kvps)
+		Expect(names(kvps)).To(Equal([]string{"a", "b", "c", "y", "z"}))
+	})
+
+	It("should break ties on tier when names are equal", func() {
+		kvps := []*KVPair{
+			{Key: PolicyKey{Tier: "t2", Name: "a"}, Value: Policy{}},
+			{Key: PolicyKey{Tier: "t1", Name: "a"}, Value: Policy{}},
+		}
+		SortPoliciesByOrder(kvps)
+		Expect(kvps[0].Key).To(Equal(PolicyKey{Tier: "t1", Name: "a"}))
+	})
+
+	It("should accept parsed *Policy values", func() {
+		kvps := []*KVPair{
+			{Key: PolicyKey{Tier: "t", Name: "nil"}, Value: &Policy{}},
+			{Key: PolicyKey{Tier: "t", Name: "two"}, Value: &Policy{Order: orderPtr(2)}},
+			policyKVP("one", orderPtr(1)),
+		}
+		SortPoliciesByOrder(kvps)
+		Expect(names(kvps)).To(Equal([]string{"one", "two", "nil"}))
+	})
+
+	It("should sort KVPairs with other key types after policies with the same order", func() {
+		other := &KVPair{Key: TierKey{Name: "t"}, Value: Policy{Order: orderPtr(1)}}
+		noKey := &KVPair{Value: Policy{}}
+		kvps := []*KVPair{noKey, policyKVP("b", nil), other, policyKVP("a", orderPtr(1))}
+		Expect(func() { SortPoliciesByOrder(kvps) }).NotTo(Panic())
+		Expect(kvps).To(Equal([]*KVPair{policyKVP("a", orderPtr(1)), other, policyKVP("b", nil), noKey}))
+	})
+})
+
+var _ = Describe("ValidatePolicies", func() {
+	It("should accept valid policies", func() {
+		policies := map[PolicyKey]Policy{
+			{Tier: "t", Name: "a"}: {Selector: `a == "b"`},
+			{Tier: "t", Name: "b"}: {
+				InboundRules: []Rule{{Action: "allow", Protocol: &tcpProto, DstPorts: ports}},
+			},
+		}
+		Expect(ValidatePolicies(policies)).To(BeEmpty())
+	})
+
+	It("should report every invalid policy", func() {
+		policies := map[PolicyKey]Policy{
+			{Tier: "t", Name: "bad-rule"}: {
+				Selector:      "all()",
+				InboundRules:  []Rule{{Action: "allow"}},
+				OutboundRules: []Rule{{Action: "allow"}, {Action: "allow", SrcPorts: ports}},
+			},
+			{Tier: "t", Name: "good"}: {Selector: `has(a)`},
+			{Tier: "t", Name: "bad-selector"}: {
+				Selector:     `a ==`,
+				InboundRules: []Rule{{Action: "allow", ICMPType: &icmpType}},
+			},
+		}
+		Expect(ValidatePolicies(policies)).To(Equal([]error{
+			errors.ErrorResourceInvalid{
+				Identifier: PolicyKey{Tier: "t", Name: "bad-rule"},
+				Err: errors.ErrorValidation{ErrFields: []errors.ErroredField{
+					{Name: "outbound_rules[1].src_ports", Value: ports},
+				}},
+			},
+			errors.ErrorResourceInvalid{
+				Identifier: PolicyKey{Tier: "t", Name: "bad-selector"},
+				Err: errors.ErrorValidation{ErrFields: []errors.ErroredField{
+					{Name: "selector", Value: `a ==`},
+					{Name: "inbound_rules[0].icmp_type", Value: icmpType},
+				}},
+			},
+		}))
+	})
+})
+
+var _ = Describe("Policy RulesForIPVersion", func() {
+	v4Rule := Rule{Action: "allow", IPVersion: &ipv4}
+	v6Rule := Rule{Action: "deny", IPVersion: &ipv6}
+	v4NetRule := Rule{Action: "allow", SrcNet: cidr}
+	v6NetRule := Rule{Action: "allow", DstNet: cidrV6}
+	anyRule := Rule{Action: "allow", Protocol: &tcpProto}
+	policy := Policy{
+		InboundRules:  []Rule{v4Rule, anyRule, v6Rule, v6NetRule},
+		OutboundRules: []Rule{v6Rule, v4NetRule, anyRule},
+	}
+
+	It("should return the rules that apply to IPv4, in order", func() {
+		inbound, outbound := policy.RulesForIPVersion(4)
+		Expect(inbound).To(Equal([]Rule{v4Rule, anyRule}))
+		Expect(outbound).To(Equal([]Rule{v4NetRule, anyRule}))
+	})
+
+	It("should return the rules that apply to IPv6, in order", func() {
+		inbound, outbound := policy.RulesForIPVersion(6)
+		Expect(inbound).To(Equal([]Rule{anyRule, v6Rule, v6NetRule}))
+		Expect(outbound).To(Equal([]Rule{v6Rule, anyRule}))
+	})
+
+	It("should return empty slices for a policy with no rules", func() {
+		inbound, outbound := Policy{}.RulesForIPVersion(4)
+		Expect(inbound).To(BeEmpty())
+		Expect(outbound).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Policy Diff", func() {
+	ruleA := Rule{Action: "allow", Protocol: &tcpProto}
+	ruleB := Rule{Action: "deny", SrcNet: cidr}
+	ruleC := Rule{Action: "allow", DstTag: "c"}
+	ruleD := Rule{Action: "deny", DstTag: "d"}
+	policy := Policy{
+		Order:         orderPtr(10),
+		Selector:      `a == "b"`,
+		InboundRules:  []Rule{ruleA, ruleB},
+		OutboundRules: []Rule{ruleC},
+	}
+
+	It("should report no changes for an identical policy", func() {
+		diff := policy.Diff(policy.DeepCopy())
+		Expect(diff.IsEmpty()).To(BeTrue())
+		Expect(diff).To(Equal(PolicyDiff{}))
+	})
+
+	It("should report a selector-only change", func() {
+		other := policy.DeepCopy()
+		other.Selector = "has(a)"
+		Expect(policy.Diff(other)).To(Equal(PolicyDiff{SelectorChanged: true}))
+	})
+
+	It("should report an order-only change", func() {
+		other := policy.DeepCopy()
+		other.Order = orderPtr(20)
+		Expect(policy.Diff(other)).To(Equal(PolicyDiff{OrderChanged: true}))
+		other.Order = nil
+		Expect(policy.Diff(other)).To(Equal(PolicyDiff{OrderChanged: true}))
+	})
+
+	It("should report reordered rules as moves", func() {
+		other := policy.DeepCopy()
+		other.InboundRules = []Rule{ruleB, ruleA}
+		Expect(policy.Diff(other)).To(Equal(PolicyDiff{
+			InboundRules: RulesDiff{Moved: []RuleMove{{1, 0}, {0, 1}}},
+		}))
+	})
+
+	It("should report a rule changed in place as modified", func() {
+		other := policy.DeepCopy()
+		other.OutboundRules[0].DstTag = "e"
+		Expect(policy.Diff(other)).To(Equal(PolicyDiff{
+			OutboundRules: RulesDiff{Modified: []int{0}},
+		}))
+	})
+
+	It("should report added and removed rules", func() {
+		other := policy.DeepCopy()
+		other.InboundRules = []Rule{ruleB}
+		other.OutboundRules = []Rule{ruleD, ruleC}
+		Expect(policy.Diff(other)).To(Equal(PolicyDiff{
+			InboundRules:  RulesDiff{Removed: []int{0}, Moved: []RuleMove{{1, 0}}},
+			OutboundRules: RulesDiff{Added: []int{0}, Moved: []RuleMove{{0, 1}}},
+		}))
+	})
+
+	It("should report rules removed from the end", func() {
+		other := policy.DeepCopy()
+		other.InboundRules = []Rule{ruleA}
+		Expect(policy.Diff(other)).To(Equal(PolicyDiff{
+			InboundRules: RulesDiff{Removed: []int{1}},
+		}))
+	})
+})
+
+var _ = Describe("PermittedSelectorOperators", func() {
+	AfterEach(func() {
+		PermittedSelectorOperators = nil
+	})
+
+	It("should permit any valid selector when not set", func() {
+		Expect(ValidateSelector(`has_profile("p") || a =~ "b"`)).To(Succeed())
+		Expect(ValidateSelector(`a ==`)).NotTo(Succeed())
+	})
+
+	It("should reject selectors using operators that are not permitted", func() {
+		PermittedSelectorOperators = map[string]bool{"==": true, "&&": true, "has": true, "all": true}
+		Expect(ValidateSelector(`a == "b" && has(c)`)).To(Succeed())
+		Expect(ValidateSelector("")).To(Succeed())
+		Expect(ValidateSelector(`a == "b" || has(c)`)).NotTo(Succeed())
+		Expect(ValidateSelector(`a =~ "b"`)).NotTo(Succeed())
+
+		policy := Policy{
+			Selector:      `a iequals "b"`,
+			InboundRules:  []Rule{{Action: "allow", SrcSelector: `has(a)`}},
+			OutboundRules: []Rule{{Action: "allow", DstSelector: `a in {"b"}`}},
+		}
+		Expect(policy.Validate()).To(Equal(errors.ErrorValidation{ErrFields: []errors.ErroredField{
+			{Name: "selector", Value: `a iequals "b"`},
+			{Name: "outbound_rules[0].dst_selector", Value: `a in {"b"}`},
+		}}))
+	})
+})
+
+var _ = Describe("AllowedSelectorLabelPrefixes", func() {
+	AfterEach(func() {
+		AllowedSelectorLabelPrefixes = nil
+	})
+
+	It("should permit any label when not set", func() {
+		Expect(ValidateSelector(`a == "b" && has_prefix(c)`)).To(Succeed())
+	})
+
+	It("should reject selectors reading labels without an allowed prefix", func() {
+		AllowedSelectorLabelPrefixes = []string{"tenant-a/", "common/"}
+		Expect(ValidateSelector("")).To(Succeed())
+		Expect(ValidateSelector(`has_profile("p")`)).To(Succeed())
+		Expect(ValidateSelector(`tenant-a/role == "web" && has(common/env)`)).To(Succeed())
+		Expect(ValidateSelector(`tenant-a/role in {common/role, "x"}`)).To(Succeed())
+		Expect(ValidateSelector(`has_prefix(tenant-a/app.)`)).To(Succeed())
+		Expect(ValidateSelector(`tenant-a/role == "web" || tenant-b/role == "web"`)).NotTo(Succeed())
+		Expect(ValidateSelector(`tenant-a/role in {tenant-b/role}`)).NotTo(Succeed())
+		Expect(ValidateSelector(`!has(role)`)).NotTo(Succeed())
+		Expect(ValidateSelector(`has_prefix(tenant-)`)).NotTo(Succeed())
+
+		policy := Policy{
+			Selector:      `has(tenant-a/app)`,
+			InboundRules:  []Rule{{Action: "allow", SrcSelector: `has(tenant-b/app)`}},
+			OutboundRules: []Rule{{Action: "allow", DstSelector: `common/app == "dns"`}},
+		}
+		Expect(policy.Validate()).To(Equal(errors.ErrorValidation{ErrFields: []errors.ErroredField{
+			{Name: "inbound_rules[0].src_selector", Value: `has(tenant-b/app)`},
+		}}))
+	})
+
+	It("should reject all labels if no prefixes are allowed", func() {
+		AllowedSelectorLabelPrefixes = []string{}
+		Expect(ValidateSelector("all()")).To(Succeed())
+		Expect(ValidateSelector("has(a)")).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("Policy Compact", func() {
+	port := func(p int32) []numorstring.Port {
+		return []numorstring.Port{numorstring.PortFromInt(p)}
+	}
+	allowDst := func(ports []numorstring.Port) Rule {
+		return Rule{Action: "allow", Protocol: &tcpProto, DstNet: cidr, DstPorts: ports}
+	}
+
+	It("should merge adjacent rules that differ only in dst_ports", func() {
+		policy := Policy{
+			Selector:     "has(a)",
+			InboundRules: []Rule{allowDst(port(80)), allowDst(port(443)), allowDst(port(8080))},
+		}
+		Expect(policy.Compact()).To(Equal(Policy{
+			Selector:     "has(a)",
+			InboundRules: []Rule{allowDst(append(append(port(80), port(443)...), port(8080)...))},
+		}))
+		Expect(policy.InboundRules).To(HaveLen(3))
+	})
+
+	It("should merge adjacent rules that differ only in src_ports", func() {
+		a := Rule{Action: "deny", Protocol: &udpProto, SrcPorts: port(53)}
+		b := Rule{Action: "deny", Protocol: &udpProto, SrcPorts: port(123)}
+		merged := Rule{Action: "deny", Protocol: &udpProto, SrcPorts: append(port(53), port(123)...)}
+		Expect(Policy{OutboundRules: []Rule{a, b}}.Compact()).To(Equal(Policy{OutboundRules: []Rule{merged}}))
+	})
+
+	It("should drop adjacent duplicate rules", func() {
+		rule := Rule{Action: "allow", SrcTag: "a"}
+		Expect(Policy{InboundRules: []Rule{rule, rule, rule}}.Compact()).To(Equal(Policy{InboundRules: []Rule{rule}}))
+	})
+
+	for _, rules := range [][]Rule{
+		// Different actions.
+		{allowDst(port(80)), {Action: "deny", Protocol: &tcpProto, DstNet: cidr, DstPorts: port(443)}},
+		// Different destinations.
+		{allowDst(port(80)), {Action: "allow", Protocol: &tcpProto, DstNet: cidr24, DstPorts: port(443)}},
+		// Differ in both src_ports and dst_ports.
+		{
+			{Action: "allow", Protocol: &tcpProto, SrcPorts: port(1), DstPorts: port(80)},
+			{Action: "allow", Protocol: &tcpProto, SrcPorts: port(2), DstPorts: port(443)},
+		},
+		// An empty port list matches any port.
+		{allowDst(port(80)), allowDst(nil)},
+		// Negated port lists.
+		{
+			{Action: "allow", Protocol: &tcpProto, NotDstPorts: port(80)},
+			{Action: "allow", Protocol: &tcpProto, NotDstPorts: port(443)},
+		},
+		// Log rules.
+		{{Action: "log", SrcTag: "a"}, {Action: "log", SrcTag: "a"}},
+		// Not adjacent.
+		{allowDst(port(80)), {Action: "deny"}, allowDst(port(443))},
+	} {
+		rules := rules // For closure
+		It(fmt.Sprintf("should not merge %v", rules), func() {
+			policy := Policy{InboundRules: rules}
+			Expect(policy.Compact()).To(Equal(policy))
+		})
+	}
+
+	It("should preserve nil rule slices", func() {
+		c := Policy{}.Compact()
+		Expect(c.InboundRules).To(BeNil())
+		Expect(c.OutboundRules).To(BeNil())
+	})
+})
+
+var _ = Describe("MaxPolicyRules", func() {
+	var savedMax int
+
+	BeforeEach(func() {
+		savedMax = MaxPolicyRules
+		MaxPolicyRules = 3
+	})
+
+	AfterEach(func() {
+		MaxPolicyRules = savedMax
+	})
+
+	rules := func(n int) []Rule {
+		return make([]Rule, n)
+	}
+
+	It("should accept policies below and at the limit", func() {
+		Expect(Policy{InboundRules: rules(2), OutboundRules: rules(3)}.Validate()).To(BeNil())
+	})
+
+	It("should reject policies above the limit", func() {
+		err := Policy{InboundRules: rules(4), OutboundRules: rules(3)}.Validate()
+		Expect(err).To(Equal(errors.ErrorValidation{ErrFields: []errors.ErroredField{
+			{Name: "inbound_rules", Value: "4 rules, more than the maximum of 3"},
+		}}))
+		Expect(err.Error()).To(Equal("error with field inbound_rules = '4 rules, more than the maximum of 3'"))
+
+		err = Policy{InboundRules: rules(4), OutboundRules: rules(5)}.Validate()
+		Expect(err.(errors.ErrorValidation).ErrFields).To(HaveLen(2))
+	})
+
+	It("should not limit the rules if the maximum is zero", func() {
+		MaxPolicyRules = 0
+		Expect(Policy{InboundRules: rules(100)}.Validate()).To(BeNil())
+	})
+})
+
+var _ = Describe("Policy ContentHash", func() {
+	ruleA := Rule{Action: "allow", Protocol: &tcpProto, DstPorts: ports, SrcNet: cidr}
+	ruleB := Rule{Action: "deny", SrcSelector: `a == "b"`}
+	policy := Policy{
+		Order:         orderPtr(10),
+		Selector:      `has(a)`,
+		InboundRules:  []Rule{ruleA, ruleB},
+		OutboundRules: []Rule{ruleB},
+	}
+
+	contentHash := func(p Policy) string {
+		hash, err := p.ContentHash()
+		Expect(err).NotTo(HaveOccurred())
+		return hash
+	}
+
+	It("should hash identical policies equally", func() {
+		hash := contentHash(policy)
+		Expect(hash).To(HavePrefix("p:"))
+		Expect(contentHash(policy.DeepCopy())).To(Equal(hash))
+		Expect(contentHash(policy)).To(Equal(hash))
+	})
+
+	It("should hash equivalent spellings equally", func() {
+		upperTCP := numorstring.ProtocolFromString("TCP")
+		other := policy.DeepCopy()
+		other.Selector = "has( a )"
+		other.InboundRules[0].Protocol = &upperTCP
+		other.InboundRules[1].SrcSelector = `a=="b"`
+		Expect(contentHash(other)).To(Equal(contentHash(policy)))
+	})
+
+	It("should change the hash if the rules are reordered", func() {
+		other := policy.DeepCopy()
+		other.InboundRules = []Rule{ruleB, ruleA}
+		Expect(contentHash(other)).NotTo(Equal(contentHash(policy)))
+	})
+
+	It("should change the hash if anything else changes", func() {
+		for _, modify := range []func(p *Policy){
+			func(p *Policy) { p.Order = orderPtr(11) },
+			func(p *Policy) { p.Order = nil },
+			func(p *Policy) { p.Selector = "has(b)" },
+			func(p *Policy) { p.OutboundRules = nil },
+			func(p *Policy) { p.InboundRules[0].Action = "deny" },
+			func(p *Policy) { p.InboundRules[0].SrcNet = cidr24 },
+		} {
+			other := policy.DeepCopy()
+			modify(&other)
+			Expect(contentHash(other)).NotTo(Equal(contentHash(policy)))
+		}
+	})
+
+	It("should return an error if the policy can't be serialised", func() {
+		other := policy.DeepCopy()
+		other.InboundRules[0].SrcPorts = []numorstring.Port{{Int32OrString: numorstring.Int32OrString{Type: 5}}}
+		hash, err := other.ContentHash()
+		Expect(err).To(HaveOccurred())
+		Expect(hash).To(Equal(""))
+	})
+})
+
+var _ = Describe("EvaluatePolicyChain", func() {
+	peer := map[string]string{"role": "web", "env": "prod"}
+	getLabel := func(k string) (string, bool) {
+		v, ok := peer[k]
+		return v, ok
+	}
+	allow := Rule{Action: "allow", SrcSelector: `role == "web"`}
+	deny := Rule{Action: "deny", SrcSelector: `env == "prod"`}
+	pass := Rule{Action: "next-tier", SrcSelector: `has(role)`}
+	logRule := Rule{Action: "log"}
+	noMatch := Rule{Action: "deny", SrcSelector: `role == "db"`}
+
+	evaluate := func(direction string, tiers ...[]Policy) (string, bool) {
+		return EvaluatePolicyChain(tiers, direction, getLabel)
+	}
+
+	It("should return the action of the first matching rule", func() {
+		action, matched := evaluate("inbound",
+			[]Policy{{InboundRules: []Rule{noMatch, logRule, deny, allow}}})
+		Expect(matched).To(BeTrue())
+		Expect(action).To(Equal("deny"))
+	})
+	It("should treat a rule with no action as allow", func() {
+		action, matched := evaluate("inbound", []Policy{{InboundRules: []Rule{{}}}})
+		Expect(matched).To(BeTrue())
+		Expect(action).To(Equal("allow"))
+	})
+	It("should continue to the next policy in the tier if no rule matches", func() {
+		action, matched := evaluate("inbound",
+			[]Policy{{InboundRules: []Rule{noMatch}}, {InboundRules: []Rule{allow}}})
+		Expect(matched).To(BeTrue())
+		Expect(action).To(Equal("allow"))
+	})
+	It("should deny at the end of a tier with no match", func() {
+		action, matched := evaluate("inbound",
+			[]Policy{{InboundRules: []Rule{noMatch}}, {InboundRules: []Rule{logRule}}},
+			[]Policy{{InboundRules: []Rule{allow}}})
+		Expect(matched).To(BeTrue())
+		Expect(action).To(Equal("deny"))
+	})
+	It("should skip the rest of the tier on pass", func() {
+		action, matched := evaluate("inbound",
+			[]Policy{{InboundRules: []Rule{noMatch}}, {InboundRules: []Rule{pass, deny}}, {InboundRules: []Rule{deny}}},
+			[]Policy{{InboundRules: []Rule{allow}}})
+		Expect(matched).To(BeTrue())
+		Expect(action).To(Equal("allow"))
+	})
+	It("should propagate pass across several tiers", func() {
+		action, matched := evaluate("inbound",
+			[]Policy{{InboundRules: []Rule{pass}}},
+			[]Policy{{InboundRules: []Rule{logRule, pass, deny}}},
+			[]Policy{{InboundRules: []Rule{noMatch}}, {InboundRules: []Rule{allow}}})
+		Expect(matched).To(BeTrue())
+		Expect(action).To(Equal("allow"))
+	})
+	It("should skip empty tiers", func() {
+		action, matched := evaluate("inbound",
+			[]Policy{},
+			nil,
+			[]Policy{{InboundRules: []Rule{allow}}})
+		Expect(matched).To(BeTrue())
+		Expect(action).To(Equal("allow"))
+	})
+	It("should not match if the last tier passed", func() {
+		action, matched := evaluate("inbound",
+			[]Policy{{InboundRules: []Rule{logRule, pass, allow}}})
+		Expect(matched).To(BeFalse())
+		Expect(action).To(Equal(""))
+	})
+	It("should not match with no policies", func() {
+		_, matched := evaluate("inbound")
+		Expect(matched).To(BeFalse())
+	})
+	It("should use the rules and selectors for the direction", func() {
+		policy := Policy{
+			InboundRules:  []Rule{{Action: "deny", DstSelector: "all()"}, allow},
+			OutboundRules: []Rule{{Action: "deny", SrcSelector: "all()"}, {Action: "allow", DstSelector: `role == "web"`}},
+		}
+		action, matched := evaluate("inbound", []Policy{policy})
+		Expect(matched).To(BeTrue())
+		Expect(action).To(Equal("allow"))
+		action, matched = evaluate("outbound", []Policy{policy})
+		Expect(matched).To(BeTrue())
+		Expect(action).To(Equal("allow"))
+	})
+	It("should honour negated selectors", func() {
+		action, matched := evaluate("outbound", []Policy{{OutboundRules: []Rule{
+			{Action: "deny", NotDstSelector: `role == "web"`},
+			{Action: "allow", NotDstSelector: `role == "db"`},
+		}}})
+		Expect(matched).To(BeTrue())
+		Expect(action).To(Equal("allow"))
+	})
+	It("should not match rules with criteria other than labels", func() {
+		action, matched := evaluate("inbound", []Policy{{InboundRules: []Rule{
+			{Action: "deny", Protocol: &tcpProto},
+			{Action: "deny", SrcNet: cidr},
+			{Action: "deny", SrcTag: "web"},
+			{Action: "deny", SrcSelector: "bad selector"},
+			{Action: "allow", LogPrefix: "prefix"},
+		}}})
+		Expect(matched).To(BeTrue())
+		Expect(action).To(Equal("allow"))
+	})
+	It("should not match for an unknown direction", func() {
+		_, matched := evaluate("sideways", []Policy{{InboundRules: []Rule{allow}}})
+		Expect(matched).To(BeFalse())
+	})
+})
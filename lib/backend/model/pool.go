@@ -31,6 +31,18 @@ var (
 	typePool  = reflect.TypeOf(Pool{})
 )
 
+func init() {
+	RegisterKeyPath(matchPool, func(m []string) (Key, error) {
+		mungedCIDR := m[1]
+		cidr := strings.Replace(mungedCIDR, "-", "/", 1)
+		_, c, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		return PoolKey{CIDR: *c}, nil
+	})
+}
+
 type PoolKey struct {
 	CIDR net.IPNet `json:"-" validate:"required,name"`
 }
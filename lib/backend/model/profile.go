@@ -31,6 +31,20 @@ var (
 	typeProfile  = reflect.TypeOf(Profile{})
 )
 
+func init() {
+	RegisterKeyPath(matchProfile, func(m []string) (Key, error) {
+		pk := ProfileKey{m[1]}
+		switch m[2] {
+		case "tags":
+			return ProfileTagsKey{ProfileKey: pk}, nil
+		case "rules":
+			return ProfileRulesKey{ProfileKey: pk}, nil
+		default:
+			return ProfileLabelsKey{ProfileKey: pk}, nil
+		}
+	})
+}
+
 // The profile key actually returns the common parent of the three separate entries.
 // It is useful to define this to re-use some of the common machinery, and can be used
 // for delete processing since delete needs to remove the common parent.
@@ -42,6 +56,9 @@ func (key ProfileKey) defaultPath() (string, error) {
 	if key.Name == "" {
 		return "", errors.ErrorInsufficientIdentifiers{Name: "name"}
 	}
+	if err := checkNameSegments([]string{"name"}, key.Name); err != nil {
+		return "", err
+	}
 	e := fmt.Sprintf("/calico/v1/policy/profile/%s", key.Name)
 	return e, nil
 }
@@ -152,6 +169,38 @@ type ProfileRules struct {
 	OutboundRules []Rule `json:"outbound_rules,omitempty" validate:"omitempty,dive"`
 }
 
+// DeepCopy returns a copy of the profile rules that shares no mutable state
+// with the original.
+func (r ProfileRules) DeepCopy() ProfileRules {
+	return ProfileRules{
+		InboundRules:  copyRules(r.InboundRules),
+		OutboundRules: copyRules(r.OutboundRules),
+	}
+}
+
+// Validate checks that each of the rules passes Rule.Validate.  The returned
+// error is an errors.ErrorValidation listing every offending field, named
+// after the rule, for example "inbound_rules[0].src_ports".
+func (r ProfileRules) Validate() error {
+	verr := errors.ErrorValidation{}
+	verr.ErrFields = appendRuleErrors(verr.ErrFields, "inbound_rules", r.InboundRules)
+	verr.ErrFields = appendRuleErrors(verr.ErrFields, "outbound_rules", r.OutboundRules)
+	if len(verr.ErrFields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// Canonicalize returns a copy of the profile rules with each rule replaced by
+// its canonical form, as Rule.Canonicalize, so that equivalent rule sets
+// serialise identically.
+func (r ProfileRules) Canonicalize() ProfileRules {
+	return ProfileRules{
+		InboundRules:  canonicalRules(r.InboundRules),
+		OutboundRules: canonicalRules(r.OutboundRules),
+	}
+}
+
 type client interface {
 	Create(object *KVPair) (*KVPair, error)
 	Update(object *KVPair) (*KVPair, error)
@@ -0,0 +1,144 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model_test
+
+import (
+	. "github.com/tigera/libcalico-go/lib/backend/model"
+
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tigera/libcalico-go/lib/errors"
+	"github.com/tigera/libcalico-go/lib/numorstring"
+)
+
+var _ = Describe("ProfileListOptions", func() {
+	It("should list all profiles if no name is specified", func() {
+		l := ProfileListOptions{}
+		Expect(ListOptionsToDefaultPathRoot(l)).To(Equal("/calico/v1/policy/profile"))
+		Expect(l.KeyFromDefaultPath("/calico/v1/policy/profile/a/labels")).To(Equal(ProfileLabelsKey{ProfileKey{Name: "a"}}))
+		Expect(l.KeyFromDefaultPath("/calico/v1/policy/profile/b/rules")).To(Equal(ProfileRulesKey{ProfileKey{Name: "b"}}))
+	})
+
+	It("should only match the named profile", func() {
+		l := ProfileListOptions{Name: "a"}
+		Expect(ListOptionsToDefaultPathRoot(l)).To(Equal("/calico/v1/policy/profile/a"))
+		Expect(l.KeyFromDefaultPath("/calico/v1/policy/profile/a/tags")).To(Equal(ProfileTagsKey{ProfileKey{Name: "a"}}))
+		Expect(l.KeyFromDefaultPath("/calico/v1/policy/profile/b/tags")).To(BeNil())
+	})
+
+	It("should not match other paths", func() {
+		l := ProfileListOptions{}
+		Expect(l.KeyFromDefaultPath("/calico/v1/policy/tier/default/policy/a")).To(BeNil())
+		Expect(l.KeyFromDefaultPath("/calico/v1/policy/profile/a")).To(BeNil())
+		Expect(l.KeyFromDefaultPath("/calico/v1/policy/profile/a/unknown")).To(BeNil())
+		Expect(l.KeyFromDefaultPath("/calico/v1/policy/profile/a/rules/extra")).To(BeNil())
+	})
+
+	for _, key := range []Key{
+		ProfileRulesKey{ProfileKey{Name: "p"}},
+		ProfileTagsKey{ProfileKey{Name: "p.with-dots_and-dashes"}},
+		ProfileLabelsKey{ProfileKey{Name: "p"}},
+	} {
+		key := key // For closure
+		It(fmt.Sprintf("should round-trip %v through the list options", key), func() {
+			path, err := KeyToDefaultPath(key)
+			Expect(err).To(BeNil())
+			Expect(ProfileListOptions{}.KeyFromDefaultPath(path)).To(Equal(key))
+		})
+	}
+})
+
+var _ = Describe("ProfileRules DeepCopy", func() {
+	It("should not be affected by changes to the copy", func() {
+		rules := ProfileRules{
+			InboundRules: []Rule{{Action: "allow", SrcTag: "foo"}},
+		}
+		c := rules.DeepCopy()
+		Expect(c).To(Equal(rules))
+		c.InboundRules[0].SrcTag = "bar"
+		Expect(rules.InboundRules[0].SrcTag).To(Equal("foo"))
+	})
+})
+
+var _ = Describe("ProfileRules Validate", func() {
+	It("should accept valid rules", func() {
+		rules := ProfileRules{
+			InboundRules:  []Rule{{Action: "allow", Protocol: &tcpProto, DstPorts: ports}},
+			OutboundRules: []Rule{{Action: "deny", SrcSelector: "has(a)"}},
+		}
+		Expect(rules.Validate()).To(BeNil())
+		Expect(ProfileRules{}.Validate()).To(BeNil())
+	})
+
+	It("should report every invalid field", func() {
+		rules := ProfileRules{
+			InboundRules:  []Rule{{Action: "allow"}, {Action: "allow", SrcPorts: ports}},
+			OutboundRules: []Rule{{Action: "allow", DstSelector: "a =="}},
+		}
+		Expect(rules.Validate()).To(Equal(errors.ErrorValidation{ErrFields: []errors.ErroredField{
+			{Name: "inbound_rules[1].src_ports", Value: ports},
+			{Name: "outbound_rules[0].dst_selector", Value: "a =="},
+		}}))
+	})
+})
+
+var _ = Describe("ProfileRules Canonicalize", func() {
+	protoTCPUpper := numorstring.ProtocolFromString("TCP")
+	protoTCPNum := numorstring.ProtocolFromInt(6)
+	protoUnknownNum := numorstring.ProtocolFromString("123")
+	protoUDP := numorstring.ProtocolFromString("udp")
+	protoUnknown := numorstring.ProtocolFromString("foo")
+
+	It("should normalise protocols and selectors", func() {
+		rules := ProfileRules{
+			InboundRules: []Rule{
+				{Action: "allow", Protocol: &protoTCPUpper, SrcSelector: `a=="b"&&has( c )`},
+				{Action: "allow", NotProtocol: &protoUnknownNum, DstSelector: `!(x in {"b","a"})`},
+			},
+			OutboundRules: []Rule{{Action: "deny", Protocol: &protoTCPNum, NotDstSelector: "all( )"}},
+		}
+		Expect(rules.Canonicalize()).To(Equal(ProfileRules{
+			InboundRules: []Rule{
+				{Action: "allow", Protocol: &tcpProto, SrcSelector: `a == "b" && has(c)`},
+				{Action: "allow", NotProtocol: &intProto, DstSelector: `!x in {"a", "b"}`},
+			},
+			OutboundRules: []Rule{{Action: "deny", Protocol: &tcpProto, NotDstSelector: "all()"}},
+		}))
+	})
+
+	It("should make equivalent rule sets equal", func() {
+		a := ProfileRules{InboundRules: []Rule{{Protocol: &protoTCPNum, SrcSelector: "has(a)||has(b)"}}}
+		b := ProfileRules{InboundRules: []Rule{{Protocol: &protoTCPUpper, SrcSelector: "has(a) || (has(b))"}}}
+		Expect(a).NotTo(Equal(b))
+		Expect(a.Canonicalize()).To(Equal(b.Canonicalize()))
+	})
+
+	It("should leave invalid fields and nil rule slices alone", func() {
+		rules := ProfileRules{
+			InboundRules: []Rule{{Protocol: &protoUnknown, SrcSelector: "a =="}},
+		}
+		c := rules.Canonicalize()
+		Expect(c).To(Equal(rules))
+		Expect(c.OutboundRules).To(BeNil())
+	})
+
+	It("should not modify the original", func() {
+		rules := ProfileRules{InboundRules: []Rule{{Protocol: &protoUDP, SrcSelector: "has( a )"}}}
+		rules.Canonicalize()
+		Expect(rules.InboundRules[0].SrcSelector).To(Equal("has( a )"))
+	})
+})
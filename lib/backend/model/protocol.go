@@ -0,0 +1,63 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tigera/libcalico-go/lib/numorstring"
+)
+
+// protocolNames maps the protocol numbers that have a canonical name to that
+// name.
+var protocolNames = map[int]string{
+	1:   "icmp",
+	6:   "tcp",
+	17:  "udp",
+	58:  "icmpv6",
+	132: "sctp",
+	136: "udplite",
+}
+
+// NormalizeProtocol returns the canonical form of a protocol given by name or
+// number, so that, for example, "TCP", "tcp" and "6" all normalize to "tcp".
+// Protocols with a name are normalized to the lower-case name; other protocol
+// numbers, from 0 to 255, are normalized to the decimal number.  An error is
+// returned for an unknown protocol name or an out-of-range number.
+func NormalizeProtocol(s string) (string, error) {
+	lower := strings.ToLower(strings.TrimSpace(s))
+	if n, err := strconv.Atoi(lower); err == nil {
+		if n < 0 || n > 255 {
+			return "", fmt.Errorf("protocol number out of range: %v", s)
+		}
+		if name, ok := protocolNames[n]; ok {
+			return name, nil
+		}
+		return strconv.Itoa(n), nil
+	}
+	for _, name := range protocolNames {
+		if lower == name {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown protocol: %v", s)
+}
+
+// normalizeProtocol is NormalizeProtocol for the protocol of a rule.
+func normalizeProtocol(p *numorstring.Protocol) (string, error) {
+	return NormalizeProtocol(p.String())
+}
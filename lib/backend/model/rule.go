@@ -19,13 +19,46 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/tigera/libcalico-go/lib/errors"
 	"github.com/tigera/libcalico-go/lib/net"
 	"github.com/tigera/libcalico-go/lib/numorstring"
+	"github.com/tigera/libcalico-go/lib/selector"
+)
+
+// The rule actions understood by Felix.  A rule with no action allows.
+const (
+	ActionAllow    = "allow"
+	ActionDeny     = "deny"
+	ActionLog      = "log"
+	ActionNextTier = "next-tier"
+)
+
+var (
+	// Known rule actions.
+	ruleActions = map[string]bool{ActionAllow: true, ActionDeny: true, ActionLog: true, ActionNextTier: true}
+
+	// Protocols (in normalized form) for which port matches are allowed.
+	portProtocols = map[string]bool{"tcp": true, "udp": true, "sctp": true, "udplite": true}
+
+	// Protocols (in normalized form) for which ICMP type/code matches are
+	// allowed.
+	icmpProtocols = map[string]bool{"icmp": true, "icmpv6": true}
+)
+
+// The range of ICMP types and codes accepted by Validate, as for the
+// validation tags on the ICMP fields.
+const (
+	minICMPValue = 1
+	maxICMPValue = 255
 )
 
 type Rule struct {
 	Action string `json:"action,omitempty" validate:"backendaction"`
 
+	// IPVersion, if set, restricts the rule to packets of the given IP
+	// version (4 or 6).
+	IPVersion *int `json:"ip_version,omitempty" validate:"omitempty,eq=4|eq=6"`
+
 	Protocol    *numorstring.Protocol `json:"protocol,omitempty" validate:"omitempty"`
 	NotProtocol *numorstring.Protocol `json:"!protocol,omitempty" validate:"omitempty"`
 
@@ -36,19 +69,19 @@ type Rule struct {
 
 	SrcTag      string             `json:"src_tag,omitempty" validate:"omitempty,tag"`
 	SrcNet      *net.IPNet         `json:"src_net,omitempty" validate:"omitempty"`
-	SrcSelector string             `json:"src_selector,omitempty" validate:"omitempty,selector"`
+	SrcSelector string             `json:"src_selector,omitempty" validate:"omitempty,backendselector"`
 	SrcPorts    []numorstring.Port `json:"src_ports,omitempty" validate:"omitempty"`
 	DstTag      string             `json:"dst_tag,omitempty" validate:"omitempty,tag"`
-	DstSelector string             `json:"dst_selector,omitempty" validate:"omitempty,selector"`
+	DstSelector string             `json:"dst_selector,omitempty" validate:"omitempty,backendselector"`
 	DstNet      *net.IPNet         `json:"dst_net,omitempty" validate:"omitempty"`
 	DstPorts    []numorstring.Port `json:"dst_ports,omitempty" validate:"omitempty"`
 
 	NotSrcTag      string             `json:"!src_tag,omitempty" validate:"omitempty,tag"`
 	NotSrcNet      *net.IPNet         `json:"!src_net,omitempty" validate:"omitempty"`
-	NotSrcSelector string             `json:"!src_selector,omitempty" validate:"omitempty,selector"`
+	NotSrcSelector string             `json:"!src_selector,omitempty" validate:"omitempty,backendselector"`
 	NotSrcPorts    []numorstring.Port `json:"!src_ports,omitempty" validate:"omitempty"`
 	NotDstTag      string             `json:"!dst_tag,omitempty" validate:"omitempty"`
-	NotDstSelector string             `json:"!dst_selector,omitempty" validate:"omitempty,selector"`
+	NotDstSelector string             `json:"!dst_selector,omitempty" validate:"omitempty,backendselector"`
 	NotDstNet      *net.IPNet         `json:"!dst_net,omitempty" validate:"omitempty"`
 	NotDstPorts    []numorstring.Port `json:"!dst_ports,omitempty" validate:"omitempty"`
 
@@ -61,15 +94,18 @@ func (r Rule) String() string {
 	if r.Action != "" {
 		parts = append(parts, r.Action)
 	} else {
-		parts = append(parts, "allow")
+		parts = append(parts, ActionAllow)
+	}
+	if r.IPVersion != nil {
+		parts = append(parts, fmt.Sprintf("ipv%d", *r.IPVersion))
 	}
 
 	// Global packet attributes that don't depend on direction.
 	if r.Protocol != nil {
-		parts = append(parts, r.Protocol.String())
+		parts = append(parts, protocolString(r.Protocol))
 	}
 	if r.NotProtocol != nil {
-		parts = append(parts, "!"+r.NotProtocol.String())
+		parts = append(parts, "!"+protocolString(r.NotProtocol))
 	}
 
 	if r.ICMPType != nil {
@@ -166,3 +202,367 @@ func (r Rule) String() string {
 
 	return strings.Join(parts, " ")
 }
+
+// Validate checks the rule for fields that are individually well-formed but
+// contradictory or unparseable as a whole: the action and protocols must be
+// known, port matches require a protocol that has ports, ICMP matches require
+// an ICMP protocol and must be in range, CIDRs must be valid and of the same
+// IP version, and selectors must pass ValidateSelector.  The returned error is
+// an errors.ErrorValidation listing every offending field.
+func (r Rule) Validate() error {
+	verr := errors.ErrorValidation{}
+	addErr := func(name string, value interface{}) {
+		verr.ErrFields = append(verr.ErrFields, errors.ErroredField{Name: name, Value: value})
+	}
+
+	// The action, if specified, must be known.
+	if r.Action != "" && !ruleActions[r.Action] {
+		addErr("action", r.Action)
+	}
+
+	// The IP version, if specified, must be 4 or 6.
+	if r.IPVersion != nil && *r.IPVersion != 4 && *r.IPVersion != 6 {
+		addErr("ip_version", *r.IPVersion)
+	}
+
+	// Protocols must be known.
+	for _, f := range []struct {
+		name  string
+		value *numorstring.Protocol
+	}{
+		{"protocol", r.Protocol},
+		{"!protocol", r.NotProtocol},
+	} {
+		if f.value == nil {
+			continue
+		}
+		if _, err := normalizeProtocol(f.value); err != nil {
+			addErr(f.name, f.value.String())
+		}
+	}
+
+	// Port matches only make sense with a positive match on a protocol
+	// that has ports.
+	portsAllowed := protocolIn(r.Protocol, portProtocols)
+	for _, f := range []struct {
+		name  string
+		ports []numorstring.Port
+	}{
+		{"src_ports", r.SrcPorts},
+		{"dst_ports", r.DstPorts},
+		{"!src_ports", r.NotSrcPorts},
+		{"!dst_ports", r.NotDstPorts},
+	} {
+		if len(f.ports) > 0 && !portsAllowed {
+			addErr(f.name, f.ports)
+		}
+	}
+
+	// Likewise, ICMP type and code require an ICMP protocol and a code
+	// requires a type.  Both must be in range.
+	icmpAllowed := protocolIn(r.Protocol, icmpProtocols)
+	for _, f := range []struct {
+		name  string
+		value *int
+	}{
+		{"icmp_type", r.ICMPType},
+		{"icmp_code", r.ICMPCode},
+		{"!icmp_type", r.NotICMPType},
+		{"!icmp_code", r.NotICMPCode},
+	} {
+		if f.value == nil {
+			continue
+		}
+		if !icmpAllowed || !validICMPValue(*f.value) {
+			addErr(f.name, *f.value)
+		}
+	}
+	if icmpAllowed && r.ICMPCode != nil && r.ICMPType == nil && validICMPValue(*r.ICMPCode) {
+		addErr("icmp_code", *r.ICMPCode)
+	}
+	if icmpAllowed && r.NotICMPCode != nil && r.NotICMPType == nil && validICMPValue(*r.NotICMPCode) {
+		addErr("!icmp_code", *r.NotICMPCode)
+	}
+
+	// CIDRs must be valid and all of the same IP version, including the
+	// rule's own IP version if set, otherwise the rule can never match.
+	version := 0
+	if r.IPVersion != nil && (*r.IPVersion == 4 || *r.IPVersion == 6) {
+		version = *r.IPVersion
+	}
+	for _, f := range []struct {
+		name  string
+		value *net.IPNet
+	}{
+		{"src_net", r.SrcNet},
+		{"dst_net", r.DstNet},
+		{"!src_net", r.NotSrcNet},
+		{"!dst_net", r.NotDstNet},
+	} {
+		if f.value == nil {
+			continue
+		}
+		if !validIPNet(f.value) {
+			addErr(f.name, f.value)
+			continue
+		}
+		if version == 0 {
+			version = f.value.Version()
+		} else if f.value.Version() != version {
+			addErr(f.name, f.value)
+		}
+	}
+
+	// Selectors must parse and use only permitted operators.
+	for _, f := range []struct {
+		name  string
+		value string
+	}{
+		{"src_selector", r.SrcSelector},
+		{"dst_selector", r.DstSelector},
+		{"!src_selector", r.NotSrcSelector},
+		{"!dst_selector", r.NotDstSelector},
+	} {
+		if f.value == "" {
+			continue
+		}
+		if err := ValidateSelector(f.value); err != nil {
+			addErr(f.name, f.value)
+		}
+	}
+
+	if len(verr.ErrFields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// protocolIn returns true if the protocol is non-nil and its normalized form
+// is one of the given protocols.
+func protocolIn(p *numorstring.Protocol, protocols map[string]bool) bool {
+	if p == nil {
+		return false
+	}
+	name, err := normalizeProtocol(p)
+	return err == nil && protocols[name]
+}
+
+// protocolString returns the normalized form of the protocol, if it has one,
+// so that equivalent rules have the same string form.
+func protocolString(p *numorstring.Protocol) string {
+	if name, err := normalizeProtocol(p); err == nil {
+		return name
+	}
+	return p.String()
+}
+
+// validIPNet returns true if the IPNet has a valid IP and a canonical mask of
+// the matching IP version.
+func validIPNet(n *net.IPNet) bool {
+	switch _, bits := n.Mask.Size(); bits {
+	case 32:
+		return n.IP.To4() != nil
+	case 128:
+		return len(n.IP) == 16
+	default:
+		// Zero for a non-canonical mask.
+		return false
+	}
+}
+
+// MatchesSource returns true if the rule's source CIDR matches, if any, allow
+// the given IP: the IP must be in SrcNet and not in NotSrcNet.  An IP of a
+// different version to either CIDR, or to the rule's IPVersion, never
+// matches, since the rule only applies to traffic of that IP version.
+func (r Rule) MatchesSource(ip net.IP) bool {
+	return r.netsMatch(ip, r.SrcNet, r.NotSrcNet)
+}
+
+// MatchesDest is the destination equivalent of MatchesSource, using DstNet
+// and NotDstNet.
+func (r Rule) MatchesDest(ip net.IP) bool {
+	return r.netsMatch(ip, r.DstNet, r.NotDstNet)
+}
+
+func (r Rule) netsMatch(ip net.IP, n, notN *net.IPNet) bool {
+	if ip.IP == nil {
+		return false
+	}
+	version := ip.Version()
+	if r.IPVersion != nil && *r.IPVersion != version {
+		return false
+	}
+	if n != nil && (n.Version() != version || !n.Contains(ip.IP)) {
+		return false
+	}
+	if notN != nil && (notN.Version() != version || notN.Contains(ip.IP)) {
+		return false
+	}
+	return true
+}
+
+// MatchesICMP returns true if the rule's ICMP type and code matches allow a
+// packet with the given ICMP type and code.  A negated type and code together
+// exclude only that combination, whereas a negated type alone excludes every
+// code of that type.  The protocol is not checked, so a rule with no ICMP
+// matches allows any type and code.
+func (r Rule) MatchesICMP(typ, code int) bool {
+	if r.ICMPType != nil && *r.ICMPType != typ {
+		return false
+	}
+	if r.ICMPCode != nil && *r.ICMPCode != code {
+		return false
+	}
+	if r.NotICMPType != nil && *r.NotICMPType == typ &&
+		(r.NotICMPCode == nil || *r.NotICMPCode == code) {
+		return false
+	}
+	return true
+}
+
+func validICMPValue(v int) bool {
+	return v >= minICMPValue && v <= maxICMPValue
+}
+
+// IsDeny returns true if the rule denies the packets that it matches.
+func (r Rule) IsDeny() bool {
+	return r.Action == ActionDeny
+}
+
+// AppliesToIPVersion returns true if the rule can match packets of the given
+// IP version: its IPVersion, if set, must equal the version, as must that of
+// each of its CIDRs.
+func (r Rule) AppliesToIPVersion(version int) bool {
+	if r.IPVersion != nil && *r.IPVersion != version {
+		return false
+	}
+	for _, n := range []*net.IPNet{r.SrcNet, r.DstNet, r.NotSrcNet, r.NotDstNet} {
+		if n != nil && n.Version() != version {
+			return false
+		}
+	}
+	return true
+}
+
+// DeepCopy returns a copy of the rule that shares no mutable state with the
+// original.
+func (r Rule) DeepCopy() Rule {
+	c := r
+	c.IPVersion = copyInt(r.IPVersion)
+	c.Protocol = copyProtocol(r.Protocol)
+	c.NotProtocol = copyProtocol(r.NotProtocol)
+	c.ICMPType = copyInt(r.ICMPType)
+	c.ICMPCode = copyInt(r.ICMPCode)
+	c.NotICMPType = copyInt(r.NotICMPType)
+	c.NotICMPCode = copyInt(r.NotICMPCode)
+	c.SrcNet = copyIPNet(r.SrcNet)
+	c.SrcPorts = copyPorts(r.SrcPorts)
+	c.DstNet = copyIPNet(r.DstNet)
+	c.DstPorts = copyPorts(r.DstPorts)
+	c.NotSrcNet = copyIPNet(r.NotSrcNet)
+	c.NotSrcPorts = copyPorts(r.NotSrcPorts)
+	c.NotDstNet = copyIPNet(r.NotDstNet)
+	c.NotDstPorts = copyPorts(r.NotDstPorts)
+	return c
+}
+
+// Canonicalize returns a deep copy of the rule in canonical form: protocols
+// are normalized, as NormalizeProtocol, and selectors are replaced by their
+// canonical string form.  Fields that fail to normalize or parse are left
+// unchanged, for Validate to report.
+func (r Rule) Canonicalize() Rule {
+	c := r.DeepCopy()
+	c.Protocol = canonicalProtocol(c.Protocol)
+	c.NotProtocol = canonicalProtocol(c.NotProtocol)
+	c.SrcSelector = canonicalSelector(c.SrcSelector)
+	c.DstSelector = canonicalSelector(c.DstSelector)
+	c.NotSrcSelector = canonicalSelector(c.NotSrcSelector)
+	c.NotDstSelector = canonicalSelector(c.NotDstSelector)
+	return c
+}
+
+func canonicalProtocol(p *numorstring.Protocol) *numorstring.Protocol {
+	if p == nil {
+		return nil
+	}
+	name, err := normalizeProtocol(p)
+	if err != nil {
+		return p
+	}
+	var c numorstring.Protocol
+	if num, err := strconv.Atoi(name); err == nil {
+		c = numorstring.ProtocolFromInt(int32(num))
+	} else {
+		c = numorstring.ProtocolFromString(name)
+	}
+	return &c
+}
+
+func canonicalSelector(s string) string {
+	if s == "" {
+		return s
+	}
+	sel, err := selector.Parse(s)
+	if err != nil {
+		return s
+	}
+	return sel.String()
+}
+
+// canonicalRules returns the canonical form of each of the rules, preserving
+// nil.
+func canonicalRules(rules []Rule) []Rule {
+	if rules == nil {
+		return nil
+	}
+	c := make([]Rule, len(rules))
+	for ii, rule := range rules {
+		c[ii] = rule.Canonicalize()
+	}
+	return c
+}
+
+// copyRules returns a deep copy of a slice of rules, preserving nil.
+func copyRules(rules []Rule) []Rule {
+	if rules == nil {
+		return nil
+	}
+	c := make([]Rule, len(rules))
+	for ii, rule := range rules {
+		c[ii] = rule.DeepCopy()
+	}
+	return c
+}
+
+func copyProtocol(p *numorstring.Protocol) *numorstring.Protocol {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	return &c
+}
+
+func copyInt(i *int) *int {
+	if i == nil {
+		return nil
+	}
+	c := *i
+	return &c
+}
+
+func copyIPNet(n *net.IPNet) *net.IPNet {
+	if n == nil {
+		return nil
+	}
+	c := *n
+	c.IP = append(c.IP[:0:0], n.IP...)
+	c.Mask = append(c.Mask[:0:0], n.Mask...)
+	return &c
+}
+
+func copyPorts(ports []numorstring.Port) []numorstring.Port {
+	if ports == nil {
+		return nil
+	}
+	return append(ports[:0:0], ports...)
+}
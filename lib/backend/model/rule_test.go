@@ -21,6 +21,7 @@ import (
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/tigera/libcalico-go/lib/errors"
 	"github.com/tigera/libcalico-go/lib/net"
 	"github.com/tigera/libcalico-go/lib/numorstring"
 )
@@ -35,6 +36,8 @@ var icmpProto = numorstring.ProtocolFromString("icmp")
 var intProto = numorstring.ProtocolFromInt(123)
 var icmpType = 10
 var icmpCode = 6
+var ipv4 = 4
+var ipv6 = 6
 var ports = []numorstring.Port{
 	numorstring.PortFromInt(1234),
 	numorstring.PortFromRange(10, 20),
@@ -54,6 +57,7 @@ var ruleStringTests = []ruleTest{
 
 	// Explicit actions, packet-wide matches.
 	{Rule{Action: "allow", Protocol: &tcpProto}, "allow tcp"},
+	{Rule{Action: "deny", IPVersion: &ipv6, Protocol: &tcpProto}, "deny ipv6 tcp"},
 	{Rule{Action: "deny", Protocol: &icmpProto, ICMPType: &icmpType},
 		"deny icmp type 10"},
 	{Rule{Protocol: &icmpProto, ICMPType: &icmpType, ICMPCode: &icmpCode},
@@ -110,3 +114,305 @@ var _ = Describe("Rule", func() {
 		})
 	}
 })
+
+var _ = Describe("Rule DeepCopy", func() {
+	var rule Rule
+
+	BeforeEach(func() {
+		proto := numorstring.ProtocolFromString("icmp")
+		icmpType := 10
+		_, srcNet, _ := net.ParseCIDR("10.0.0.0/16")
+		ipVersion := 4
+		rule = Rule{
+			Action:    "deny",
+			IPVersion: &ipVersion,
+			Protocol:  &proto,
+			ICMPType:  &icmpType,
+			SrcNet:    srcNet,
+			SrcPorts:  []numorstring.Port{numorstring.PortFromInt(1234)},
+			DstTag:    "foo",
+		}
+	})
+
+	It("should produce an equal rule", func() {
+		Expect(rule.DeepCopy()).To(Equal(rule))
+	})
+
+	It("should not be affected by changes to the copy", func() {
+		original := rule.String()
+		c := rule.DeepCopy()
+		*c.Protocol = numorstring.ProtocolFromString("tcp")
+		*c.IPVersion = 6
+		*c.ICMPType = 11
+		c.SrcNet.IP[0] = 11
+		c.SrcPorts[0] = numorstring.PortFromInt(4567)
+		c.DstTag = "bar"
+		Expect(rule.String()).To(Equal(original))
+		Expect(c.String()).NotTo(Equal(original))
+	})
+})
+
+var udpProto = numorstring.ProtocolFromString("udp")
+var tcpNumProto = numorstring.ProtocolFromInt(6)
+var icmpv6Proto = numorstring.ProtocolFromString("icmpv6")
+var _, cidrV6, _ = net.ParseCIDR("fd00::/64")
+var badCIDR = &net.IPNet{}
+var badIPVersion = 5
+var zeroICMP = 0
+var bigICMP = 256
+
+var upperTCPProto = numorstring.ProtocolFromString("TCP")
+var unknownProto = numorstring.ProtocolFromString("foo")
+var bigProto = numorstring.ProtocolFromInt(256)
+
+var validRules = []Rule{
+	{},
+	{Action: "deny"},
+	{Action: "log"},
+	{Action: "next-tier"},
+	{Action: "allow", Protocol: &tcpProto, SrcPorts: ports, DstPorts: ports2},
+	{Protocol: &udpProto, NotSrcPorts: ports, NotDstPorts: ports2},
+	{Protocol: &tcpNumProto, DstPorts: ports},
+	{Protocol: &upperTCPProto, DstPorts: ports},
+	{Protocol: &icmpProto, ICMPType: &icmpType, ICMPCode: &icmpCode},
+	{Protocol: &icmpv6Proto, NotICMPType: &icmpType, NotICMPCode: &icmpCode},
+	{SrcNet: cidr, DstNet: cidr, NotSrcNet: cidr, NotDstNet: cidr},
+	{SrcNet: cidrV6, NotDstNet: cidrV6},
+	{IPVersion: &ipv4, SrcNet: cidr},
+	{IPVersion: &ipv6, DstNet: cidrV6},
+	{SrcSelector: `a == "b"`, DstSelector: "has(c)", NotSrcSelector: "all()", NotDstSelector: ""},
+}
+
+var invalidRules = []struct {
+	rule      Rule
+	badFields []string
+}{
+	{Rule{Action: "reject"}, []string{"action"}},
+	{Rule{Action: "Allow", SrcPorts: ports}, []string{"action", "src_ports"}},
+	{Rule{SrcPorts: ports}, []string{"src_ports"}},
+	{Rule{Protocol: &unknownProto}, []string{"protocol"}},
+	{Rule{NotProtocol: &bigProto}, []string{"!protocol"}},
+	{Rule{Protocol: &unknownProto, DstPorts: ports}, []string{"protocol", "dst_ports"}},
+	{Rule{Protocol: &icmpProto, DstPorts: ports}, []string{"dst_ports"}},
+	{Rule{NotProtocol: &tcpProto, NotSrcPorts: ports, NotDstPorts: ports},
+		[]string{"!src_ports", "!dst_ports"}},
+	{Rule{Protocol: &intProto, DstPorts: ports}, []string{"dst_ports"}},
+	{Rule{ICMPType: &icmpType}, []string{"icmp_type"}},
+	{Rule{Protocol: &tcpProto, NotICMPType: &icmpType, NotICMPCode: &icmpCode},
+		[]string{"!icmp_type", "!icmp_code"}},
+	{Rule{Protocol: &icmpProto, ICMPCode: &icmpCode}, []string{"icmp_code"}},
+	{Rule{Protocol: &icmpProto, ICMPType: &zeroICMP}, []string{"icmp_type"}},
+	{Rule{Protocol: &icmpProto, ICMPType: &icmpType, ICMPCode: &bigICMP}, []string{"icmp_code"}},
+	{Rule{Protocol: &icmpv6Proto, NotICMPType: &bigICMP, NotICMPCode: &zeroICMP},
+		[]string{"!icmp_type", "!icmp_code"}},
+	{Rule{Protocol: &icmpProto, NotICMPCode: &bigICMP}, []string{"!icmp_code"}},
+	{Rule{Protocol: &icmpProto, NotICMPCode: &icmpCode}, []string{"!icmp_code"}},
+	{Rule{SrcNet: badCIDR}, []string{"src_net"}},
+	{Rule{SrcNet: cidr, DstNet: cidrV6}, []string{"dst_net"}},
+	{Rule{NotSrcNet: cidrV6, NotDstNet: cidr}, []string{"!dst_net"}},
+	{Rule{IPVersion: &badIPVersion}, []string{"ip_version"}},
+	{Rule{IPVersion: &ipv6, SrcNet: cidr}, []string{"src_net"}},
+	{Rule{IPVersion: &ipv4, NotDstNet: cidrV6}, []string{"!dst_net"}},
+	{Rule{SrcSelector: `a == `}, []string{"src_selector"}},
+	{Rule{DstSelector: `a == "b"`, NotDstSelector: "(has(a)"}, []string{"!dst_selector"}},
+	{Rule{SrcPorts: ports, SrcSelector: "%", DstNet: badCIDR},
+		[]string{"src_ports", "dst_net", "src_selector"}},
+}
+
+var _ = Describe("Rule Validate", func() {
+	for _, rule := range validRules {
+		rule := rule // For closure
+		It(fmt.Sprintf("should accept %s", rule), func() {
+			Expect(rule.Validate()).To(BeNil())
+		})
+	}
+
+	for _, test := range invalidRules {
+		test := test // For closure
+		It(fmt.Sprintf("should reject %s with bad fields %v", test.rule, test.badFields), func() {
+			err := test.rule.Validate()
+			Expect(err).To(BeAssignableToTypeOf(errors.ErrorValidation{}))
+			names := []string{}
+			for _, f := range err.(errors.ErrorValidation).ErrFields {
+				names = append(names, f.Name)
+			}
+			Expect(names).To(Equal(test.badFields))
+		})
+	}
+})
+
+var _ = Describe("Rule MatchesICMP", func() {
+	otherType := 11
+	otherCode := 7
+
+	It("should match any type and code with no ICMP matches", func() {
+		Expect(Rule{Protocol: &icmpProto}.MatchesICMP(3, 4)).To(BeTrue())
+	})
+	It("should match every code of the type with a type only", func() {
+		rule := Rule{Protocol: &icmpProto, ICMPType: &icmpType}
+		Expect(rule.MatchesICMP(icmpType, icmpCode)).To(BeTrue())
+		Expect(rule.MatchesICMP(icmpType, otherCode)).To(BeTrue())
+		Expect(rule.MatchesICMP(otherType, icmpCode)).To(BeFalse())
+	})
+	It("should match only the type and code with both", func() {
+		rule := Rule{Protocol: &icmpProto, ICMPType: &icmpType, ICMPCode: &icmpCode}
+		Expect(rule.MatchesICMP(icmpType, icmpCode)).To(BeTrue())
+		Expect(rule.MatchesICMP(icmpType, otherCode)).To(BeFalse())
+		Expect(rule.MatchesICMP(otherType, icmpCode)).To(BeFalse())
+	})
+	It("should exclude every code of a negated type", func() {
+		rule := Rule{Protocol: &icmpProto, NotICMPType: &icmpType}
+		Expect(rule.MatchesICMP(icmpType, icmpCode)).To(BeFalse())
+		Expect(rule.MatchesICMP(icmpType, otherCode)).To(BeFalse())
+		Expect(rule.MatchesICMP(otherType, icmpCode)).To(BeTrue())
+	})
+	It("should exclude only a negated type and code combination", func() {
+		rule := Rule{Protocol: &icmpProto, NotICMPType: &icmpType, NotICMPCode: &icmpCode}
+		Expect(rule.MatchesICMP(icmpType, icmpCode)).To(BeFalse())
+		Expect(rule.MatchesICMP(icmpType, otherCode)).To(BeTrue())
+		Expect(rule.MatchesICMP(otherType, icmpCode)).To(BeTrue())
+	})
+	It("should combine positive and negated matches", func() {
+		rule := Rule{Protocol: &icmpProto, ICMPType: &icmpType, NotICMPType: &icmpType, NotICMPCode: &icmpCode}
+		Expect(rule.MatchesICMP(icmpType, icmpCode)).To(BeFalse())
+		Expect(rule.MatchesICMP(icmpType, otherCode)).To(BeTrue())
+		Expect(rule.MatchesICMP(otherType, otherCode)).To(BeFalse())
+	})
+})
+
+var normalizeProtocolTests = []struct {
+	input    string
+	expected string
+}{
+	{"tcp", "tcp"},
+	{"TCP", "tcp"},
+	{" Udp ", "udp"},
+	{"6", "tcp"},
+	{"006", "tcp"},
+	{"17", "udp"},
+	{"1", "icmp"},
+	{"58", "icmpv6"},
+	{"ICMPv6", "icmpv6"},
+	{"132", "sctp"},
+	{"136", "udplite"},
+	{"0", "0"},
+	{"123", "123"},
+	{"255", "255"},
+}
+
+var _ = Describe("NormalizeProtocol", func() {
+	for _, test := range normalizeProtocolTests {
+		test := test // For closure
+		It(fmt.Sprintf("should normalize %#v to %#v", test.input, test.expected), func() {
+			Expect(NormalizeProtocol(test.input)).To(Equal(test.expected))
+		})
+	}
+
+	for _, input := range []string{"foo", "", "tcp6", "-1", "256"} {
+		input := input // For closure
+		It(fmt.Sprintf("should reject %#v", input), func() {
+			_, err := NormalizeProtocol(input)
+			Expect(err).NotTo(BeNil())
+		})
+	}
+
+	It("should give equivalent rules the same string form", func() {
+		Expect(Rule{Protocol: &upperTCPProto}.String()).To(Equal(Rule{Protocol: &tcpNumProto}.String()))
+	})
+})
+
+var _, cidr24, _ = net.ParseCIDR("10.0.1.0/24")
+var _, cidrV6Sub, _ = net.ParseCIDR("fd00::/80")
+
+var ruleNetMatchTests = []struct {
+	net, notNet *net.IPNet
+	ip          string
+	expected    bool
+}{
+	// No CIDRs matches any IP.
+	{nil, nil, "10.0.0.1", true},
+	{nil, nil, "fd00::1", true},
+	// Positive match only.
+	{cidr, nil, "10.0.0.1", true},
+	{cidr, nil, "10.0.255.255", true},
+	{cidr, nil, "10.1.0.1", false},
+	{cidr, nil, "fd00::1", false},
+	{cidrV6, nil, "fd00::1", true},
+	{cidrV6, nil, "fd01::1", false},
+	{cidrV6, nil, "10.0.0.1", false},
+	// Negative match only.
+	{nil, cidr, "10.0.0.1", false},
+	{nil, cidr, "10.1.0.1", true},
+	{nil, cidr, "fd00::1", false},
+	{nil, cidrV6, "fd01::1", true},
+	{nil, cidrV6, "10.0.0.1", false},
+	// Both.
+	{cidr, cidr24, "10.0.0.1", true},
+	{cidr, cidr24, "10.0.1.1", false},
+	{cidr, cidr24, "10.1.0.1", false},
+	{cidrV6, cidrV6Sub, "fd00::1:0:0:1", true},
+	{cidrV6, cidrV6Sub, "fd00::1", false},
+}
+
+var _ = Describe("Rule MatchesSource and MatchesDest", func() {
+	for _, test := range ruleNetMatchTests {
+		test := test // For closure
+		It(fmt.Sprintf("should return %v for %v with nets %v and %v", test.expected, test.ip, test.net, test.notNet), func() {
+			ip := net.IP{}
+			Expect(ip.UnmarshalText([]byte(test.ip))).To(Succeed())
+			srcRule := Rule{SrcNet: test.net, NotSrcNet: test.notNet}
+			Expect(srcRule.MatchesSource(ip)).To(Equal(test.expected))
+			Expect(srcRule.MatchesDest(ip)).To(BeTrue())
+			dstRule := Rule{DstNet: test.net, NotDstNet: test.notNet}
+			Expect(dstRule.MatchesDest(ip)).To(Equal(test.expected))
+			Expect(dstRule.MatchesSource(ip)).To(BeTrue())
+		})
+	}
+
+	It("should not match a nil IP", func() {
+		Expect(Rule{}.MatchesSource(net.IP{})).To(BeFalse())
+	})
+
+	It("should not match an IP of a different version to the rule", func() {
+		ip := net.IP{}
+		Expect(ip.UnmarshalText([]byte("10.0.0.1"))).To(Succeed())
+		Expect(Rule{IPVersion: &ipv4}.MatchesSource(ip)).To(BeTrue())
+		Expect(Rule{IPVersion: &ipv6}.MatchesSource(ip)).To(BeFalse())
+		Expect(Rule{IPVersion: &ipv6}.MatchesDest(ip)).To(BeFalse())
+	})
+})
+
+var ruleIPVersionTests = []struct {
+	rule        Rule
+	appliesToV4 bool
+	appliesToV6 bool
+}{
+	{Rule{}, true, true},
+	{Rule{IPVersion: &ipv4}, true, false},
+	{Rule{IPVersion: &ipv6}, false, true},
+	{Rule{SrcNet: cidr}, true, false},
+	{Rule{NotDstNet: cidrV6}, false, true},
+	{Rule{IPVersion: &ipv4, DstNet: cidr}, true, false},
+	// Inconsistent rules never match, so apply to neither version.
+	{Rule{IPVersion: &ipv6, DstNet: cidr}, false, false},
+	{Rule{SrcNet: cidr, DstNet: cidrV6}, false, false},
+}
+
+var _ = Describe("Rule AppliesToIPVersion", func() {
+	for _, test := range ruleIPVersionTests {
+		test := test // For closure
+		It(fmt.Sprintf("should return %v/%v for %s", test.appliesToV4, test.appliesToV6, test.rule), func() {
+			Expect(test.rule.AppliesToIPVersion(4)).To(Equal(test.appliesToV4))
+			Expect(test.rule.AppliesToIPVersion(6)).To(Equal(test.appliesToV6))
+		})
+	}
+})
+
+var _ = Describe("Rule IsDeny", func() {
+	It("should only be true for deny rules", func() {
+		Expect(Rule{Action: ActionDeny}.IsDeny()).To(BeTrue())
+		for _, action := range []string{"", ActionAllow, ActionLog, ActionNextTier} {
+			Expect(Rule{Action: action}.IsDeny()).To(BeFalse(), action)
+		}
+	})
+})
@@ -0,0 +1,90 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tigera/libcalico-go/lib/selector"
+	"github.com/tigera/libcalico-go/lib/selector/parser"
+)
+
+// PermittedSelectorOperators, if not nil, is the set of selector operators
+// and functions, named as by Selector.Operators, that ValidateSelector
+// accepts.  Deployments can restrict it so that policies using selector
+// syntax that the running Felix does not support are rejected.  A nil set
+// permits everything that parses.  This is not thread safe and should be set
+// during initialisation.
+var PermittedSelectorOperators map[string]bool
+
+// AllowedSelectorLabelPrefixes, if not nil, restricts the label keys that
+// ValidateSelector accepts to those starting with one of the prefixes, so
+// that, for example, a tenant's policies can only select on labels within the
+// tenant's namespace.  The prefixes passed to has_prefix() must also start
+// with an allowed prefix.  A nil list permits any label key.  This is not
+// thread safe and should be set during initialisation.
+var AllowedSelectorLabelPrefixes []string
+
+// ValidateSelector returns an error if the selector fails to parse, uses an
+// operator or function that is not in PermittedSelectorOperators or reads a
+// label key that is not allowed by AllowedSelectorLabelPrefixes.  It is used
+// to validate backend policy and rule selectors, including by the
+// "backendselector" validator tag.  API selectors, which use the "selector"
+// tag, are only checked to parse, so the allow-lists don't apply to them.
+func ValidateSelector(s string) error {
+	sel, err := selector.Parse(s)
+	if err != nil {
+		return err
+	}
+	if PermittedSelectorOperators != nil {
+		for _, op := range sel.Operators() {
+			if !PermittedSelectorOperators[op] {
+				return fmt.Errorf("selector operator %q is not permitted", op)
+			}
+		}
+	}
+	if AllowedSelectorLabelPrefixes != nil {
+		for _, key := range sel.LabelKeys() {
+			if !labelKeyAllowed(key) {
+				return fmt.Errorf("selector label %q is not allowed", key)
+			}
+		}
+		// has_prefix() doesn't read a fixed label key, so check its
+		// prefix separately.
+		var prefixErr error
+		sel.Transform(func(n parser.Node) parser.Node {
+			if n, ok := n.(parser.HasPrefixNode); ok && prefixErr == nil && !labelKeyAllowed(n.Prefix) {
+				prefixErr = fmt.Errorf("selector label prefix %q is not allowed", n.Prefix)
+			}
+			return n
+		})
+		if prefixErr != nil {
+			return prefixErr
+		}
+	}
+	return nil
+}
+
+// labelKeyAllowed returns true if the label key, or label key prefix, starts
+// with one of the AllowedSelectorLabelPrefixes.
+func labelKeyAllowed(key string) bool {
+	for _, prefix := range AllowedSelectorLabelPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
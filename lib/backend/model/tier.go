@@ -24,11 +24,21 @@ import (
 	"github.com/tigera/libcalico-go/lib/errors"
 )
 
+// DefaultTierName is the name of the tier used for policies that don't specify
+// a tier.
+const DefaultTierName = "default"
+
 var (
 	matchTier = regexp.MustCompile("^/?calico/v1/policy/tier/([^/]+)/metadata$")
 	typeTier  = reflect.TypeOf(Tier{})
 )
 
+func init() {
+	RegisterKeyPath(matchTier, func(m []string) (Key, error) {
+		return TierKey{Name: m[1]}, nil
+	})
+}
+
 type TierKey struct {
 	Name string `json:"-" validate:"required,name"`
 }
@@ -42,6 +52,9 @@ func (key TierKey) defaultDeletePath() (string, error) {
 	if key.Name == "" {
 		return "", errors.ErrorInsufficientIdentifiers{Name: "name"}
 	}
+	if err := checkNameSegments([]string{"name"}, key.Name); err != nil {
+		return "", err
+	}
 	e := fmt.Sprintf("/calico/v1/policy/tier/%s", key.Name)
 	return e, nil
 }
@@ -85,3 +98,33 @@ func (options TierListOptions) KeyFromDefaultPath(path string) Key {
 type Tier struct {
 	Order *float32 `json:"order,omitempty"`
 }
+
+// SortTiersByOrder sorts a list of tier KVPairs (each with a TierKey and a
+// Tier or *Tier value, as returned when listing with TierListOptions) into the
+// order in which they should be evaluated.  Tiers are sorted by ascending
+// Order, with tiers that have a nil Order last.  Ties are broken by tier name,
+// so the result is deterministic.  Values of other types are treated as
+// having a nil Order, and KVPairs with other key types sort after the tiers
+// with the same order.
+func SortTiersByOrder(tiers []*KVPair) {
+	sortKVPairsByOrder(tiers, tierOrder, tierNames)
+}
+
+// tierNames returns the tier name, which breaks ties in SortTiersByOrder, or
+// false if the key is not a TierKey.
+func tierNames(key Key) ([]string, bool) {
+	k, ok := key.(TierKey)
+	return []string{k.Name}, ok
+}
+
+func tierOrder(value interface{}) *float32 {
+	switch tier := value.(type) {
+	case Tier:
+		return tier.Order
+	case *Tier:
+		if tier != nil {
+			return tier.Order
+		}
+	}
+	return nil
+}
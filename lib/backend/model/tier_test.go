@@ -0,0 +1,98 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model_test
+
+import (
+	. "github.com/tigera/libcalico-go/lib/backend/model"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func tierKVP(name string, order *float32) *KVPair {
+	return &KVPair{
+		Key:   TierKey{Name: name},
+		Value: Tier{Order: order},
+	}
+}
+
+var _ = Describe("SortTiersByOrder", func() {
+	names := func(kvps []*KVPair) []string {
+		result := []string{}
+		for _, kvp := range kvps {
+			result = append(result, kvp.Key.(TierKey).Name)
+		}
+		return result
+	}
+
+	It("should sort by order with nil orders last", func() {
+		tiers := []*KVPair{
+			tierKVP("a", nil),
+			tierKVP("b", orderPtr(10)),
+			tierKVP("c", orderPtr(-1)),
+			tierKVP("d", nil),
+			tierKVP("e", orderPtr(2.5)),
+		}
+		SortTiersByOrder(tiers)
+		Expect(names(tiers)).To(Equal([]string{"c", "e", "b", "a", "d"}))
+	})
+
+	It("should break ties on name", func() {
+		tiers := []*KVPair{
+			tierKVP("z", orderPtr(1)),
+			tierKVP("y", nil),
+			tierKVP("x", orderPtr(1)),
+			tierKVP("w", nil),
+		}
+		SortTiersByOrder(tiers)
+		Expect(names(tiers)).To(Equal([]string{"x", "z", "w", "y"}))
+	})
+
+	It("should accept parsed *Tier values", func() {
+		b, err := ParseValue(TierKey{Name: "b"}, []byte(`{"order": 1}`))
+		Expect(err).To(BeNil())
+		a, err := ParseValue(TierKey{Name: "a"}, []byte(`{}`))
+		Expect(err).To(BeNil())
+		tiers := []*KVPair{
+			{Key: TierKey{Name: "a"}, Value: a},
+			{Key: TierKey{Name: "b"}, Value: b},
+		}
+		SortTiersByOrder(tiers)
+		Expect(names(tiers)).To(Equal([]string{"b", "a"}))
+	})
+
+	It("should sort KVPairs with other key types after tiers with the same order", func() {
+		other := &KVPair{Key: ProfileKey{Name: "p"}, Value: Tier{Order: orderPtr(1)}}
+		noKey := &KVPair{Value: Tier{}}
+		tiers := []*KVPair{noKey, tierKVP("b", nil), other, tierKVP("a", orderPtr(1))}
+		Expect(func() { SortTiersByOrder(tiers) }).NotTo(Panic())
+		Expect(tiers).To(Equal([]*KVPair{tierKVP("a", orderPtr(1)), other, tierKVP("b", nil), noKey}))
+	})
+})
+
+var _ = Describe("TierListOptions", func() {
+	It("should round-trip a tier key through its path", func() {
+		path, err := KeyToDefaultPath(TierKey{Name: "t"})
+		Expect(err).To(BeNil())
+		Expect(path).To(Equal("/calico/v1/policy/tier/t/metadata"))
+		Expect(TierListOptions{}.KeyFromDefaultPath(path)).To(Equal(TierKey{Name: "t"}))
+		Expect(TierListOptions{Name: "t"}.KeyFromDefaultPath(path)).To(Equal(TierKey{Name: "t"}))
+		Expect(TierListOptions{Name: "u"}.KeyFromDefaultPath(path)).To(BeNil())
+	})
+
+	It("should not match policy paths", func() {
+		Expect(TierListOptions{}.KeyFromDefaultPath("/calico/v1/policy/tier/t/policy/p")).To(BeNil())
+	})
+})
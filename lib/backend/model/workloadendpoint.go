@@ -30,6 +30,17 @@ var (
 	matchWorkloadEndpoint = regexp.MustCompile("^/?calico/v1/host/([^/]+)/workload/([^/]+)/([^/]+)/endpoint/([^/]+)$")
 )
 
+func init() {
+	RegisterKeyPath(matchWorkloadEndpoint, func(m []string) (Key, error) {
+		return WorkloadEndpointKey{
+			Hostname:       m[1],
+			OrchestratorID: m[2],
+			WorkloadID:     m[3],
+			EndpointID:     m[4],
+		}, nil
+	})
+}
+
 type WorkloadEndpointKey struct {
 	Hostname       string `json:"-"`
 	OrchestratorID string `json:"-"`
@@ -50,6 +61,9 @@ func (key WorkloadEndpointKey) defaultPath() (string, error) {
 	if key.EndpointID == "" {
 		return "", errors.ErrorInsufficientIdentifiers{Name: "endpointID"}
 	}
+	if err := key.checkPathSegments(); err != nil {
+		return "", err
+	}
 	return fmt.Sprintf("/calico/v1/host/%s/workload/%s/%s/endpoint/%s",
 		key.Hostname, key.OrchestratorID, key.WorkloadID, key.EndpointID), nil
 }
@@ -64,6 +78,9 @@ func (key WorkloadEndpointKey) defaultDeletePath() (string, error) {
 	if key.WorkloadID == "" {
 		return "", errors.ErrorInsufficientIdentifiers{Name: "workload"}
 	}
+	if err := key.checkPathSegments(); err != nil {
+		return "", err
+	}
 	if key.EndpointID == "" {
 		return fmt.Sprintf("/calico/v1/host/%s/workload/%s/%s/",
 			key.Hostname, key.OrchestratorID, key.WorkloadID), nil
@@ -72,6 +89,11 @@ func (key WorkloadEndpointKey) defaultDeletePath() (string, error) {
 		key.Hostname, key.OrchestratorID, key.WorkloadID, key.EndpointID), nil
 }
 
+func (key WorkloadEndpointKey) checkPathSegments() error {
+	return checkPathSegments([]string{"hostname", "orchestrator", "workload", "endpointID"},
+		key.Hostname, key.OrchestratorID, key.WorkloadID, key.EndpointID)
+}
+
 func (key WorkloadEndpointKey) valueType() reflect.Type {
 	return reflect.TypeOf(WorkloadEndpoint{})
 }
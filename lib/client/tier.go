@@ -21,7 +21,7 @@ import (
 )
 
 const (
-	DefaultTierName = "default"
+	DefaultTierName = model.DefaultTierName
 )
 
 // TierInterface has methods to work with Tier resources.
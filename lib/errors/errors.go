@@ -59,6 +59,17 @@ func (e ErrorConnectionUnauthorized) Error() string {
 	return "connection is unauthorized"
 }
 
+// Error indicating a resource failed validation.  Err is typically an
+// ErrorValidation listing the offending fields.
+type ErrorResourceInvalid struct {
+	Err        error
+	Identifier interface{}
+}
+
+func (e ErrorResourceInvalid) Error() string {
+	return fmt.Sprintf("resource is invalid: %s: %v", e.Identifier, e.Err)
+}
+
 // Validation error containing the fields that are failed validation.
 type ErrorValidation struct {
 	ErrFields []ErroredField
@@ -105,3 +116,21 @@ type ErrorResourceUpdateConflict struct {
 func (e ErrorResourceUpdateConflict) Error() string {
 	return fmt.Sprintf("update conflict: '%s'", e.Identifier)
 }
+
+// Error indicating a datastore path that does not correspond to any known key type.
+type ErrorUnrecognizedPath struct {
+	Path string
+}
+
+func (e ErrorUnrecognizedPath) Error() string {
+	return fmt.Sprintf("unrecognized datastore path: %s", e.Path)
+}
+
+// Error indicating a key for which no value type or value parser is known.
+type ErrorUnrecognizedKeyType struct {
+	Key interface{}
+}
+
+func (e ErrorUnrecognizedKeyType) Error() string {
+	return fmt.Sprintf("no value parser for key type %T", e.Key)
+}
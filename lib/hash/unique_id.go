@@ -22,6 +22,14 @@ import (
 // MakeUniqueID uses a secure hash to create a unique ID from content.
 // The hash is prefixed with "<prefix>:".
 func MakeUniqueID(prefix, content string) string {
+	return MakeUniqueIDN(prefix, content, crypto.SHA224.Size())
+}
+
+// MakeUniqueIDN is like MakeUniqueID but keeps only the first numBytes bytes
+// of the hash, for use where the length of the ID is limited.  Shorter IDs
+// are correspondingly more likely to collide.  numBytes is clamped to the
+// range 1 to the full size of the hash.
+func MakeUniqueIDN(prefix, content string, numBytes int) string {
 	hash := crypto.SHA224.New()
 	bytes := []byte(prefix + ":" + content)
 	written, err := hash.Write(bytes)
@@ -32,5 +40,10 @@ func MakeUniqueID(prefix, content string) string {
 		panic("Failed to write to Hash")
 	}
 	hashBytes := hash.Sum(make([]byte, 0, hash.Size()))
-	return prefix + ":" + base64.RawURLEncoding.EncodeToString(hashBytes)
+	if numBytes < 1 {
+		numBytes = 1
+	} else if numBytes > len(hashBytes) {
+		numBytes = len(hashBytes)
+	}
+	return prefix + ":" + base64.RawURLEncoding.EncodeToString(hashBytes[:numBytes])
 }
@@ -0,0 +1,111 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/tigera/libcalico-go/lib/selector/parser"
+)
+
+// DefaultCacheSize is the number of parsed selectors held by the cache used
+// by ParseCached.
+const DefaultCacheSize = 1024
+
+var defaultCache = NewCache(DefaultCacheSize)
+
+// ParseCached is equivalent to Parse but returns a previously parsed Selector
+// if the same selector string has been parsed recently.  Selectors that fail
+// to parse are not cached.
+func ParseCached(selector string) (sel parser.Selector, err error) {
+	return defaultCache.Parse(selector)
+}
+
+// Cache is a concurrency-safe, size-bounded cache of parsed selectors, keyed
+// by selector string.  When full, the least recently used entry is evicted.
+type Cache struct {
+	mutex   sync.Mutex
+	maxSize int
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	selector string
+	parsed   parser.Selector
+}
+
+// NewCache creates a Cache that holds at most maxSize parsed selectors.
+func NewCache(maxSize int) *Cache {
+	if maxSize < 1 {
+		maxSize = 1
+	}
+	return &Cache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Parse returns the cached Selector for the given string, parsing and caching
+// it if it is not already present.
+func (c *Cache) Parse(selector string) (parser.Selector, error) {
+	c.mutex.Lock()
+	if elem, ok := c.entries[selector]; ok {
+		c.lru.MoveToFront(elem)
+		c.mutex.Unlock()
+		return elem.Value.(*cacheEntry).parsed, nil
+	}
+	c.mutex.Unlock()
+
+	// Parse outside the lock; in a race, the last writer wins, which is
+	// harmless since both results are equivalent.
+	parsed, err := parser.Parse(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.entries[selector]; ok {
+		c.lru.MoveToFront(elem)
+		elem.Value.(*cacheEntry).parsed = parsed
+		return parsed, nil
+	}
+	c.entries[selector] = c.lru.PushFront(&cacheEntry{selector, parsed})
+	for c.lru.Len() > c.maxSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).selector)
+	}
+	return parsed, nil
+}
+
+// Len returns the number of selectors currently in the cache.
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lru.Len()
+}
+
+// Contains returns true if the selector string is in the cache.  It does not
+// count as a use of the entry for the purposes of eviction.
+func (c *Cache) Contains(selector string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, ok := c.entries[selector]
+	return ok
+}
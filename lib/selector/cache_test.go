@@ -0,0 +1,108 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selector_test
+
+import (
+	. "github.com/tigera/libcalico-go/lib/selector"
+
+	"fmt"
+	"sync"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cache", func() {
+	var cache *Cache
+
+	BeforeEach(func() {
+		cache = NewCache(2)
+	})
+
+	It("should return the same result as Parse", func() {
+		sel, err := cache.Parse(`a == "b"`)
+		Expect(err).To(BeNil())
+		parsed, err := Parse(`a == "b"`)
+		Expect(err).To(BeNil())
+		Expect(sel.String()).To(Equal(parsed.String()))
+		Expect(sel.UniqueId()).To(Equal(parsed.UniqueId()))
+	})
+
+	It("should not cache selectors that fail to parse", func() {
+		_, err := cache.Parse(`a ==`)
+		Expect(err).NotTo(BeNil())
+		Expect(cache.Len()).To(Equal(0))
+		Expect(cache.Contains(`a ==`)).To(BeFalse())
+	})
+
+	It("should evict the least recently used selector", func() {
+		_, err := cache.Parse(`a == "1"`)
+		Expect(err).To(BeNil())
+		_, err = cache.Parse(`a == "2"`)
+		Expect(err).To(BeNil())
+		// Touch the first entry so that the second becomes the oldest.
+		_, err = cache.Parse(`a == "1"`)
+		Expect(err).To(BeNil())
+		_, err = cache.Parse(`a == "3"`)
+		Expect(err).To(BeNil())
+		Expect(cache.Len()).To(Equal(2))
+		Expect(cache.Contains(`a == "1"`)).To(BeTrue())
+		Expect(cache.Contains(`a == "2"`)).To(BeFalse())
+		Expect(cache.Contains(`a == "3"`)).To(BeTrue())
+	})
+
+	It("should be safe for concurrent use", func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					sel, err := cache.Parse(fmt.Sprintf(`a == "%d"`, j%3))
+					Expect(err).To(BeNil())
+					Expect(sel.Evaluate(map[string]string{"a": fmt.Sprint(j % 3)})).To(BeTrue())
+				}
+			}(i)
+		}
+		wg.Wait()
+		Expect(cache.Len()).To(Equal(2))
+	})
+
+	It("should parse via the default cache", func() {
+		sel, err := ParseCached(`has(a)`)
+		Expect(err).To(BeNil())
+		Expect(sel.String()).To(Equal("has(a)"))
+	})
+})
+
+const benchmarkSelector = `(a == "b" && c in {"d", "e", "f"}) || !has(g) || h > 10`
+
+func BenchmarkParse(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse(benchmarkSelector); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseCached(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseCached(benchmarkSelector); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package selector parses and evaluates label selectors, such as
+`role == "web" && has(env)`, as used by Calico policy.
+
+String literals may be delimited by double or single quotes.  Within a
+literal, a backslash escapes the delimiting quote or another backslash, so
+`a == "he said \"hi\""` matches the value `he said "hi"`; any other
+backslash is taken literally, so "c:\temp" contains a backslash.
+
+Backslash escapes are an incompatible change to the selector syntax.
+Previously, a backslash was always taken literally and a literal ended at
+the first matching quote.  Selectors stored by earlier versions re-parse
+differently if a literal contains a backslash immediately before the
+closing quote, or two adjacent backslashes:
+
+	"C:\"    was the value C:\, but is now an unterminated literal
+	'a\\b'   was the value a\\b, but is now a\b
+
+Such selectors must be rewritten, as "C:\\" and 'a\\\\b' respectively, before
+upgrading.  Selectors written by String() always use the escaped form.
+*/
+package selector
@@ -16,6 +16,9 @@ package parser
 
 import (
 	_ "crypto/sha256"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/tigera/libcalico-go/lib/hash"
@@ -23,18 +26,146 @@ import (
 
 type Selector interface {
 	Evaluate(labels map[string]string) bool
+	EvaluateFunc(get func(key string) (string, bool)) bool
+	EvaluateWithProfiles(labels map[string]string, profileIDs []string) bool
+	EvaluateMulti(labels map[string][]string) bool
+	EvaluateWithDefaults(labels, defaults map[string]string) bool
+	EvaluateWithAnnotations(labels, annotations map[string]string) bool
+	EvaluateStrict(labels map[string]string) (bool, error)
 	String() string
 	UniqueId() string
+	UniqueIdN(numBytes int) string
+	Equal(other Selector) bool
+	Implies(other Selector) bool
+	LabelKeys() []string
+	Operators() []string
+	ConstantConstraints() (map[string][]string, bool)
+	Explain(labels map[string]string) (bool, string)
+	Transform(fn func(node Node) Node) Selector
+	Simplify() Selector
+	Negate() Selector
 }
 
 type selectorRoot struct {
-	root         node
+	root         Node
 	cachedString *string
 	cachedHash   *string
 }
 
 func (sel selectorRoot) Evaluate(labels map[string]string) bool {
-	return sel.root.Evaluate(labels)
+	return sel.EvaluateFunc(LabelsGetter(labels))
+}
+
+// LabelsGetter returns a get function, for EvaluateFunc, that looks up keys
+// in the labels map and also answers the keys returned by PrefixLabelKey, so
+// that EvaluateFunc(LabelsGetter(labels)) is equivalent to Evaluate(labels).
+func LabelsGetter(labels map[string]string) func(key string) (string, bool) {
+	return func(key string) (string, bool) {
+		if val, ok := labels[key]; ok {
+			return val, true
+		}
+		if strings.HasPrefix(key, prefixLabelKeyPrefix) {
+			prefix := key[len(prefixLabelKeyPrefix):]
+			for labelKey := range labels {
+				if strings.HasPrefix(labelKey, prefix) {
+					return "", true
+				}
+			}
+		}
+		return "", false
+	}
+}
+
+// CaseInsensitiveLabelsGetter is like LabelsGetter but ignores the case of
+// label keys, both in the labels and in the selector, so that `App == "web"`
+// and `app == "web"` both match app=web or APP=web.  If the labels have keys
+// that differ only in case, a key that is already lower-case takes precedence,
+// then the first in sorted order.  Label values are still case sensitive.
+func CaseInsensitiveLabelsGetter(labels map[string]string) func(key string) (string, bool) {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	lowered := make(map[string]string, len(labels))
+	for _, key := range keys {
+		lowerKey := strings.ToLower(key)
+		if _, ok := lowered[lowerKey]; ok && key != lowerKey {
+			continue
+		}
+		lowered[lowerKey] = labels[key]
+	}
+	get := LabelsGetter(lowered)
+	return func(key string) (string, bool) {
+		return get(strings.ToLower(key))
+	}
+}
+
+// EvaluateFunc evaluates the selector against labels that are looked up on
+// demand via the get function, avoiding the need to build a merged label map.
+// For has_prefix() to match, get must also answer the keys returned by
+// PrefixLabelKey.
+func (sel selectorRoot) EvaluateFunc(get func(key string) (string, bool)) bool {
+	return sel.root.EvaluateFunc(get)
+}
+
+// EvaluateWithProfiles evaluates the selector against an endpoint's labels
+// and the IDs of the profiles it belongs to, which are tested by
+// has_profile().  Evaluate and EvaluateFunc see no profiles, unless the get
+// function answers for the keys returned by ProfileLabelKey.
+func (sel selectorRoot) EvaluateWithProfiles(labels map[string]string, profileIDs []string) bool {
+	getLabel := LabelsGetter(labels)
+	return sel.EvaluateFunc(func(key string) (string, bool) {
+		if val, ok := getLabel(key); ok {
+			return val, true
+		}
+		for _, id := range profileIDs {
+			if key == ProfileLabelKey(id) {
+				return "", true
+			}
+		}
+		return "", false
+	})
+}
+
+// EvaluateWithDefaults evaluates the selector against the labels, using the
+// value in defaults for any label that is missing.  For example, with the
+// default env=prod, `env == "prod"` matches an endpoint with no env label.
+// Defaulted labels count as present, so has(env) also matches.
+func (sel selectorRoot) EvaluateWithDefaults(labels, defaults map[string]string) bool {
+	getLabel := LabelsGetter(labels)
+	getDefault := LabelsGetter(defaults)
+	return sel.EvaluateFunc(func(key string) (string, bool) {
+		if val, ok := getLabel(key); ok {
+			return val, true
+		}
+		return getDefault(key)
+	})
+}
+
+// AnnotationKeyPrefix is the prefix that routes a key to the annotations in
+// EvaluateWithAnnotations.
+const AnnotationKeyPrefix = "annotation/"
+
+// EvaluateWithAnnotations evaluates the selector against an endpoint's labels
+// and annotations.  Keys starting with AnnotationKeyPrefix are looked up, with
+// the prefix removed, in the annotations, so `annotation/owner == "alice"`
+// tests the owner annotation, and all other keys in the labels.  Similarly,
+// has_prefix(annotation/team.) matches if any annotation key starts with
+// "team.".
+func (sel selectorRoot) EvaluateWithAnnotations(labels, annotations map[string]string) bool {
+	getLabel := LabelsGetter(labels)
+	getAnnotation := LabelsGetter(annotations)
+	annotationPrefixKey := PrefixLabelKey(AnnotationKeyPrefix)
+	return sel.EvaluateFunc(func(key string) (string, bool) {
+		if strings.HasPrefix(key, AnnotationKeyPrefix) {
+			return getAnnotation(key[len(AnnotationKeyPrefix):])
+		}
+		if strings.HasPrefix(key, annotationPrefixKey) {
+			return getAnnotation(PrefixLabelKey(key[len(annotationPrefixKey):]))
+		}
+		return getLabel(key)
+	})
 }
 
 func (sel selectorRoot) String() string {
@@ -54,11 +185,65 @@ func (sel selectorRoot) UniqueId() string {
 	return *sel.cachedHash
 }
 
+// UniqueIdN is like UniqueId but keeps only the first numBytes bytes of the
+// hash, for use where IDs must be short, such as in iptables chain names.
+// The ID is stable for a given selector but, as for any truncated hash,
+// shorter IDs are more likely to collide.
+func (sel selectorRoot) UniqueIdN(numBytes int) string {
+	return hash.MakeUniqueIDN("s", sel.String(), numBytes)
+}
+
+// LabelKeys returns the sorted set of label keys that the selector reads.
+func (sel selectorRoot) LabelKeys() []string {
+	keySet := make(map[string]bool)
+	sel.root.collectLabelKeys(keySet)
+	keys := make([]string, 0, len(keySet))
+	for key := range keySet {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Transform returns a new Selector with every node of the parsed expression
+// rewritten by fn.  Nodes are visited bottom-up, so fn sees the operands of
+// an AndNode, OrNode or NotNode (already transformed) before the node itself.
+// The returned Selector's String() and UniqueId() reflect the rewritten
+// expression.
+func (sel selectorRoot) Transform(fn func(node Node) Node) Selector {
+	return selectorRoot{root: transformNode(sel.root, fn)}
+}
+
+func transformNode(n Node, fn func(node Node) Node) Node {
+	switch n := n.(type) {
+	case AndNode:
+		operands := make([]Node, len(n.Operands))
+		for i, op := range n.Operands {
+			operands[i] = transformNode(op, fn)
+		}
+		return fn(AndNode{operands})
+	case OrNode:
+		operands := make([]Node, len(n.Operands))
+		for i, op := range n.Operands {
+			operands[i] = transformNode(op, fn)
+		}
+		return fn(OrNode{operands})
+	case NotNode:
+		return fn(NotNode{transformNode(n.Operand, fn)})
+	default:
+		return fn(n)
+	}
+}
+
 var _ Selector = (*selectorRoot)(nil)
 
-type node interface {
-	Evaluate(labels map[string]string) bool
+// Node is a node in the parsed selector expression.  The concrete node types
+// are exported so that callers can inspect and rewrite them via
+// Selector.Transform.
+type Node interface {
+	EvaluateFunc(get func(key string) (string, bool)) bool
 	collectFragments(fragments []string) []string
+	collectLabelKeys(keys map[string]bool)
 }
 
 type LabelEqValueNode struct {
@@ -66,8 +251,8 @@ type LabelEqValueNode struct {
 	Value     string
 }
 
-func (node LabelEqValueNode) Evaluate(labels map[string]string) bool {
-	if val, ok := labels[node.LabelName]; ok {
+func (node LabelEqValueNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	if val, ok := get(node.LabelName); ok {
 		return val == node.Value
 	} else {
 		return false
@@ -75,22 +260,22 @@ func (node LabelEqValueNode) Evaluate(labels map[string]string) bool {
 }
 
 func (node LabelEqValueNode) collectFragments(fragments []string) []string {
-	var quote string
-	if strings.Contains(node.Value, `"`) {
-		quote = `'`
-	} else {
-		quote = `"`
-	}
-	return append(fragments, node.LabelName, " == ", quote, node.Value, quote)
+	return append(fragments, node.LabelName, " == ", quoteString(node.Value))
 }
 
+func (node LabelEqValueNode) collectLabelKeys(keys map[string]bool) {
+	keys[node.LabelName] = true
+}
+
+// LabelInSetNode matches if the label is present and its value is in the set.
+// An empty set never matches.
 type LabelInSetNode struct {
 	LabelName string
 	Value     map[string]bool
 }
 
-func (node LabelInSetNode) Evaluate(labels map[string]string) bool {
-	if val, ok := labels[node.LabelName]; ok {
+func (node LabelInSetNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	if val, ok := get(node.LabelName); ok {
 		return node.Value[val]
 	} else {
 		return false
@@ -98,33 +283,23 @@ func (node LabelInSetNode) Evaluate(labels map[string]string) bool {
 }
 
 func (node LabelInSetNode) collectFragments(fragments []string) []string {
-	var quote string
-	fragments = append(fragments, node.LabelName, " in {")
-	first := true
-	for s, _ := range node.Value {
-		if strings.Contains(s, `"`) {
-			quote = `'`
-		} else {
-			quote = `"`
-		}
-		if !first {
-			fragments = append(fragments, ", ")
-		} else {
-			first = false
-		}
-		fragments = append(fragments, quote, s, quote)
-	}
-	fragments = append(fragments, "}")
-	return fragments
+	fragments = append(fragments, node.LabelName, " in ")
+	return appendSetFragments(fragments, node.Value)
 }
 
+func (node LabelInSetNode) collectLabelKeys(keys map[string]bool) {
+	keys[node.LabelName] = true
+}
+
+// LabelNotInSetNode matches if the label is absent or its value is not in the
+// set.  An empty set always matches.
 type LabelNotInSetNode struct {
 	LabelName string
 	Value     map[string]bool
 }
 
-func (node LabelNotInSetNode) Evaluate(labels map[string]string) bool {
-	if val, ok := labels[node.LabelName]; ok {
+func (node LabelNotInSetNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	if val, ok := get(node.LabelName); ok {
 		return !node.Value[val]
 	} else {
 		return true
@@ -132,24 +307,118 @@ func (node LabelNotInSetNode) Evaluate(labels map[string]string) bool {
 }
 
 func (node LabelNotInSetNode) collectFragments(fragments []string) []string {
-	var quote string
-	fragments = append(fragments, node.LabelName, " not in {")
-	first := true
-	for s, _ := range node.Value {
-		if strings.Contains(s, `"`) {
-			quote = `'`
-		} else {
-			quote = `"`
-		}
-		if !first {
-			fragments = append(fragments, ", ")
-		} else {
-			first = false
+	fragments = append(fragments, node.LabelName, " not in ")
+	return appendSetFragments(fragments, node.Value)
+}
+
+func (node LabelNotInSetNode) collectLabelKeys(keys map[string]bool) {
+	keys[node.LabelName] = true
+}
+
+// LabelInRefSetNode matches if the label is present and its value is either
+// in the set of literal values or equal to the value of one of the referenced
+// labels, as in "a in {b, "c"}".  Referenced labels that are absent don't
+// match anything.
+type LabelInRefSetNode struct {
+	LabelName string
+	Value     map[string]bool
+	Refs      map[string]bool
+}
+
+func (node LabelInRefSetNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	val, ok := get(node.LabelName)
+	if !ok {
+		return false
+	}
+	if node.Value[val] {
+		return true
+	}
+	for ref := range node.Refs {
+		if refVal, ok := get(ref); ok && refVal == val {
+			return true
 		}
-		fragments = append(fragments, quote, s, quote)
 	}
-	fragments = append(fragments, "}")
-	return fragments
+	return false
+}
+
+func (node LabelInRefSetNode) collectFragments(fragments []string) []string {
+	fragments = append(fragments, node.LabelName, " in ")
+	return appendRefSetFragments(fragments, node.Value, node.Refs)
+}
+
+func (node LabelInRefSetNode) collectLabelKeys(keys map[string]bool) {
+	keys[node.LabelName] = true
+	for ref := range node.Refs {
+		keys[ref] = true
+	}
+}
+
+// LabelNotInRefSetNode is the negation of LabelInRefSetNode: it matches if
+// the label is absent or its value is neither in the set of literal values
+// nor equal to the value of any of the referenced labels.
+type LabelNotInRefSetNode struct {
+	LabelName string
+	Value     map[string]bool
+	Refs      map[string]bool
+}
+
+func (node LabelNotInRefSetNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	return !LabelInRefSetNode(node).EvaluateFunc(get)
+}
+
+func (node LabelNotInRefSetNode) collectFragments(fragments []string) []string {
+	fragments = append(fragments, node.LabelName, " not in ")
+	return appendRefSetFragments(fragments, node.Value, node.Refs)
+}
+
+func (node LabelNotInRefSetNode) collectLabelKeys(keys map[string]bool) {
+	LabelInRefSetNode(node).collectLabelKeys(keys)
+}
+
+// LabelInNumberSetNode matches if the label's value, parsed as a number, is
+// in the set.  A missing or non-numeric label never matches.
+type LabelInNumberSetNode struct {
+	LabelName string
+	Value     map[float64]bool
+}
+
+func (node LabelInNumberSetNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	if val, ok := labelAsNumber(get, node.LabelName); ok {
+		return node.Value[val]
+	}
+	return false
+}
+
+func (node LabelInNumberSetNode) collectFragments(fragments []string) []string {
+	fragments = append(fragments, node.LabelName, " in ")
+	return appendNumberSetFragments(fragments, node.Value)
+}
+
+func (node LabelInNumberSetNode) collectLabelKeys(keys map[string]bool) {
+	keys[node.LabelName] = true
+}
+
+// LabelNotInNumberSetNode matches if the label is absent, is not numeric or
+// its numeric value is not in the set.
+type LabelNotInNumberSetNode struct {
+	LabelName string
+	Value     map[float64]bool
+}
+
+func (node LabelNotInNumberSetNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	if val, ok := labelAsNumber(get, node.LabelName); ok {
+		return !node.Value[val]
+	}
+	return true
+}
+
+func (node LabelNotInNumberSetNode) collectFragments(fragments []string) []string {
+	fragments = append(fragments, node.LabelName, " not in ")
+	return appendNumberSetFragments(fragments, node.Value)
+}
+
+func (node LabelNotInNumberSetNode) collectLabelKeys(keys map[string]bool) {
+	keys[node.LabelName] = true
 }
 
 type LabelNeValueNode struct {
@@ -157,8 +426,8 @@ type LabelNeValueNode struct {
 	Value     string
 }
 
-func (node LabelNeValueNode) Evaluate(labels map[string]string) bool {
-	if val, ok := labels[node.LabelName]; ok {
+func (node LabelNeValueNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	if val, ok := get(node.LabelName); ok {
 		return val != node.Value
 	} else {
 		return true
@@ -166,21 +435,358 @@ func (node LabelNeValueNode) Evaluate(labels map[string]string) bool {
 }
 
 func (node LabelNeValueNode) collectFragments(fragments []string) []string {
-	var quote string
-	if strings.Contains(node.Value, `"`) {
-		quote = `'`
+	return append(fragments, node.LabelName, " != ", quoteString(node.Value))
+}
+
+func (node LabelNeValueNode) collectLabelKeys(keys map[string]bool) {
+	keys[node.LabelName] = true
+}
+
+// TruthyLabelValues and FalsyLabelValues are the label values that a bare
+// boolean, as in `privileged == true`, matches.  Values are compared case
+// insensitively, so the sets should hold lower-case values.  They are not
+// thread safe and should only be changed during initialisation.
+var (
+	TruthyLabelValues = map[string]bool{"true": true, "1": true, "yes": true, "on": true}
+	FalsyLabelValues  = map[string]bool{"false": true, "0": true, "no": true, "off": true}
+)
+
+// labelIsBool returns true if the label is present and its value is one of
+// the representations of the given boolean.
+func labelIsBool(get func(key string) (string, bool), labelName string, value bool) bool {
+	val, ok := get(labelName)
+	if !ok {
+		return false
+	}
+	if value {
+		return TruthyLabelValues[strings.ToLower(val)]
+	}
+	return FalsyLabelValues[strings.ToLower(val)]
+}
+
+// LabelEqBoolNode matches if the label is present and its value represents
+// the boolean, as defined by TruthyLabelValues and FalsyLabelValues.  It is
+// written with a bare true or false, as distinct from the string "true".
+type LabelEqBoolNode struct {
+	LabelName string
+	Value     bool
+}
+
+func (node LabelEqBoolNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	return labelIsBool(get, node.LabelName, node.Value)
+}
+
+func (node LabelEqBoolNode) collectFragments(fragments []string) []string {
+	return append(fragments, node.LabelName, " == ", strconv.FormatBool(node.Value))
+}
+
+func (node LabelEqBoolNode) collectLabelKeys(keys map[string]bool) {
+	keys[node.LabelName] = true
+}
+
+// LabelNeBoolNode is the negation of LabelEqBoolNode: it matches if the label
+// is absent or its value does not represent the boolean.
+type LabelNeBoolNode struct {
+	LabelName string
+	Value     bool
+}
+
+func (node LabelNeBoolNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	return !labelIsBool(get, node.LabelName, node.Value)
+}
+
+func (node LabelNeBoolNode) collectFragments(fragments []string) []string {
+	return append(fragments, node.LabelName, " != ", strconv.FormatBool(node.Value))
+}
+
+func (node LabelNeBoolNode) collectLabelKeys(keys map[string]bool) {
+	keys[node.LabelName] = true
+}
+
+type LabelIEqValueNode struct {
+	LabelName string
+	Value     string
+}
+
+func (node LabelIEqValueNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	if val, ok := get(node.LabelName); ok {
+		return strings.EqualFold(val, node.Value)
+	} else {
+		return false
+	}
+}
+
+func (node LabelIEqValueNode) collectFragments(fragments []string) []string {
+	return append(fragments, node.LabelName, " iequals ", quoteString(node.Value))
+}
+
+func (node LabelIEqValueNode) collectLabelKeys(keys map[string]bool) {
+	keys[node.LabelName] = true
+}
+
+// DefaultContainsSeparator is the separator used by the contains operator
+// unless the selector specifies one with "sep".
+const DefaultContainsSeparator = ","
+
+// LabelContainsNode matches if the label is present and, when its value is
+// split on the separator, one of the members, ignoring surrounding
+// whitespace, is equal to the value.  For example, `roles contains "api"`
+// matches roles="web, api" but not roles="apis".
+type LabelContainsNode struct {
+	LabelName string
+	Value     string
+	Separator string
+}
+
+func (node LabelContainsNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	val, ok := get(node.LabelName)
+	if !ok {
+		return false
+	}
+	for _, member := range strings.Split(val, node.Separator) {
+		if strings.TrimSpace(member) == node.Value {
+			return true
+		}
+	}
+	return false
+}
+
+func (node LabelContainsNode) collectFragments(fragments []string) []string {
+	fragments = append(fragments, node.LabelName, " contains ", quoteString(node.Value))
+	if node.Separator != DefaultContainsSeparator {
+		fragments = append(fragments, " sep ", quoteString(node.Separator))
+	}
+	return fragments
+}
+
+func (node LabelContainsNode) collectLabelKeys(keys map[string]bool) {
+	keys[node.LabelName] = true
+}
+
+type LabelRegexNode struct {
+	LabelName string
+	Regex     *regexp.Regexp
+}
+
+func (node LabelRegexNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	if val, ok := get(node.LabelName); ok {
+		return node.Regex.MatchString(val)
 	} else {
-		quote = `"`
+		return false
+	}
+}
+
+func (node LabelRegexNode) collectFragments(fragments []string) []string {
+	return append(fragments, node.LabelName, " =~ ", quoteString(node.Regex.String()))
+}
+
+func (node LabelRegexNode) collectLabelKeys(keys map[string]bool) {
+	keys[node.LabelName] = true
+}
+
+// appendSetFragments appends the canonical form of a set literal.  The members
+// are sorted so that the canonical form (and hence the UID) doesn't depend on
+// map iteration order.
+func appendSetFragments(fragments []string, set map[string]bool) []string {
+	members := make([]string, 0, len(set))
+	for s := range set {
+		members = append(members, s)
+	}
+	sort.Strings(members)
+	fragments = append(fragments, "{")
+	for i, s := range members {
+		if i > 0 {
+			fragments = append(fragments, ", ")
+		}
+		fragments = append(fragments, quoteString(s))
+	}
+	fragments = append(fragments, "}")
+	return fragments
+}
+
+// appendRefSetFragments appends a set literal containing both string values,
+// which are quoted, and label references, which are not.  The values come
+// first, then the references, each in sorted order.
+func appendRefSetFragments(fragments []string, set map[string]bool, refs map[string]bool) []string {
+	values := make([]string, 0, len(set))
+	for s := range set {
+		values = append(values, s)
+	}
+	sort.Strings(values)
+	members := make([]string, 0, len(set)+len(refs))
+	for _, s := range values {
+		members = append(members, quoteString(s))
 	}
-	return append(fragments, node.LabelName, " != ", quote, node.Value, quote)
+	refMembers := make([]string, 0, len(refs))
+	for ref := range refs {
+		refMembers = append(refMembers, ref)
+	}
+	sort.Strings(refMembers)
+	members = append(members, refMembers...)
+	fragments = append(fragments, "{")
+	for i, s := range members {
+		if i > 0 {
+			fragments = append(fragments, ", ")
+		}
+		fragments = append(fragments, s)
+	}
+	fragments = append(fragments, "}")
+	return fragments
+}
+
+// appendNumberSetFragments is the numeric equivalent of appendSetFragments;
+// members are sorted numerically and are not quoted.
+func appendNumberSetFragments(fragments []string, set map[float64]bool) []string {
+	members := make([]float64, 0, len(set))
+	for n := range set {
+		members = append(members, n)
+	}
+	sort.Float64s(members)
+	fragments = append(fragments, "{")
+	for i, n := range members {
+		if i > 0 {
+			fragments = append(fragments, ", ")
+		}
+		fragments = append(fragments, formatNumber(n))
+	}
+	fragments = append(fragments, "}")
+	return fragments
+}
+
+// quoteString renders a string literal in the canonical form used by String().
+// It prefers double quotes, falling back to single quotes if that avoids
+// escaping; otherwise, embedded double quotes are backslash-escaped.  A
+// backslash is only escaped where it would otherwise be read as an escape.
+func quoteString(value string) string {
+	quote := byte('"')
+	if strings.Contains(value, `"`) && !strings.Contains(value, `'`) {
+		quote = '\''
+	}
+	buf := []byte{quote}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == quote:
+			buf = append(buf, '\\', c)
+		case c == '\\' && (i+1 == len(value) || value[i+1] == quote || value[i+1] == '\\'):
+			buf = append(buf, '\\', c)
+		default:
+			buf = append(buf, c)
+		}
+	}
+	buf = append(buf, quote)
+	return string(buf)
+}
+
+// labelAsNumber looks up the named label and parses its value as a number.  It
+// returns false if the label is missing or its value is not numeric.
+func labelAsNumber(get func(key string) (string, bool), labelName string) (float64, bool) {
+	val, ok := get(labelName)
+	if !ok {
+		return 0, false
+	}
+	num, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, false
+	}
+	return num, true
+}
+
+// formatNumber renders a numeric literal in the canonical form used by String().
+func formatNumber(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+type LabelLtValueNode struct {
+	LabelName string
+	Value     float64
+}
+
+func (node LabelLtValueNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	if num, ok := labelAsNumber(get, node.LabelName); ok {
+		return num < node.Value
+	} else {
+		return false
+	}
+}
+
+func (node LabelLtValueNode) collectFragments(fragments []string) []string {
+	return append(fragments, node.LabelName, " < ", formatNumber(node.Value))
+}
+
+func (node LabelLtValueNode) collectLabelKeys(keys map[string]bool) {
+	keys[node.LabelName] = true
+}
+
+type LabelLeValueNode struct {
+	LabelName string
+	Value     float64
+}
+
+func (node LabelLeValueNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	if num, ok := labelAsNumber(get, node.LabelName); ok {
+		return num <= node.Value
+	} else {
+		return false
+	}
+}
+
+func (node LabelLeValueNode) collectFragments(fragments []string) []string {
+	return append(fragments, node.LabelName, " <= ", formatNumber(node.Value))
+}
+
+func (node LabelLeValueNode) collectLabelKeys(keys map[string]bool) {
+	keys[node.LabelName] = true
+}
+
+type LabelGtValueNode struct {
+	LabelName string
+	Value     float64
+}
+
+func (node LabelGtValueNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	if num, ok := labelAsNumber(get, node.LabelName); ok {
+		return num > node.Value
+	} else {
+		return false
+	}
+}
+
+func (node LabelGtValueNode) collectFragments(fragments []string) []string {
+	return append(fragments, node.LabelName, " > ", formatNumber(node.Value))
+}
+
+func (node LabelGtValueNode) collectLabelKeys(keys map[string]bool) {
+	keys[node.LabelName] = true
+}
+
+type LabelGeValueNode struct {
+	LabelName string
+	Value     float64
+}
+
+func (node LabelGeValueNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	if num, ok := labelAsNumber(get, node.LabelName); ok {
+		return num >= node.Value
+	} else {
+		return false
+	}
+}
+
+func (node LabelGeValueNode) collectFragments(fragments []string) []string {
+	return append(fragments, node.LabelName, " >= ", formatNumber(node.Value))
+}
+
+func (node LabelGeValueNode) collectLabelKeys(keys map[string]bool) {
+	keys[node.LabelName] = true
 }
 
 type HasNode struct {
 	LabelName string
 }
 
-func (node HasNode) Evaluate(labels map[string]string) bool {
-	if _, ok := labels[node.LabelName]; ok {
+func (node HasNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	if _, ok := get(node.LabelName); ok {
 		return true
 	} else {
 		return false
@@ -191,26 +797,90 @@ func (node HasNode) collectFragments(fragments []string) []string {
 	return append(fragments, "has(", node.LabelName, ")")
 }
 
+func (node HasNode) collectLabelKeys(keys map[string]bool) {
+	keys[node.LabelName] = true
+}
+
+// ProfileLabelKey returns the pseudo-label key through which has_profile()
+// looks up membership of the given profile.  Label keys cannot contain ":"
+// so the key cannot clash with a real label.
+func ProfileLabelKey(profileID string) string {
+	return "profile:" + profileID
+}
+
+// HasProfileNode matches if the endpoint belongs to the profile.
+type HasProfileNode struct {
+	ProfileID string
+}
+
+func (node HasProfileNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	_, ok := get(ProfileLabelKey(node.ProfileID))
+	return ok
+}
+
+func (node HasProfileNode) collectFragments(fragments []string) []string {
+	return append(fragments, "has_profile(", quoteString(node.ProfileID), ")")
+}
+
+func (node HasProfileNode) collectLabelKeys(keys map[string]bool) {
+	// Profile membership is not a label.
+}
+
+const prefixLabelKeyPrefix = "prefix:"
+
+// PrefixLabelKey returns the pseudo-label key through which has_prefix()
+// asks whether any label key starts with the given prefix.  As for
+// ProfileLabelKey, the key cannot clash with a real label.
+func PrefixLabelKey(prefix string) string {
+	return prefixLabelKeyPrefix + prefix
+}
+
+// HasPrefixNode matches if any label key starts with the prefix.
+type HasPrefixNode struct {
+	Prefix string
+}
+
+func (node HasPrefixNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	_, ok := get(PrefixLabelKey(node.Prefix))
+	return ok
+}
+
+func (node HasPrefixNode) collectFragments(fragments []string) []string {
+	return append(fragments, "has_prefix(", node.Prefix, ")")
+}
+
+func (node HasPrefixNode) collectLabelKeys(keys map[string]bool) {
+	// The matching keys are not known until evaluation.
+}
+
 type NotNode struct {
-	Operand node
+	Operand Node
 }
 
-func (node NotNode) Evaluate(labels map[string]string) bool {
-	return !node.Operand.Evaluate(labels)
+func (node NotNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	return !node.Operand.EvaluateFunc(get)
 }
 
 func (node NotNode) collectFragments(fragments []string) []string {
 	fragments = append(fragments, "!")
+	switch node.Operand.(type) {
+	case AndNode, OrNode:
+		return collectParenthesizedFragments(fragments, node.Operand)
+	}
 	return node.Operand.collectFragments(fragments)
 }
 
+func (node NotNode) collectLabelKeys(keys map[string]bool) {
+	node.Operand.collectLabelKeys(keys)
+}
+
 type AndNode struct {
-	Operands []node
+	Operands []Node
 }
 
-func (node AndNode) Evaluate(labels map[string]string) bool {
+func (node AndNode) EvaluateFunc(get func(key string) (string, bool)) bool {
 	for _, operand := range node.Operands {
-		if !operand.Evaluate(labels) {
+		if !operand.EvaluateFunc(get) {
 			return false
 		}
 	}
@@ -218,23 +888,33 @@ func (node AndNode) Evaluate(labels map[string]string) bool {
 }
 
 func (node AndNode) collectFragments(fragments []string) []string {
-	fragments = append(fragments, "(")
-	fragments = node.Operands[0].collectFragments(fragments)
-	for _, op := range node.Operands[1:] {
-		fragments = append(fragments, " && ")
-		fragments = op.collectFragments(fragments)
+	for i, op := range node.Operands {
+		if i > 0 {
+			fragments = append(fragments, " && ")
+		}
+		// "||" has lower precedence than "&&" so it needs parentheses.
+		if _, ok := op.(OrNode); ok {
+			fragments = collectParenthesizedFragments(fragments, op)
+		} else {
+			fragments = op.collectFragments(fragments)
+		}
 	}
-	fragments = append(fragments, ")")
 	return fragments
 }
 
+func (node AndNode) collectLabelKeys(keys map[string]bool) {
+	for _, op := range node.Operands {
+		op.collectLabelKeys(keys)
+	}
+}
+
 type OrNode struct {
-	Operands []node
+	Operands []Node
 }
 
-func (node OrNode) Evaluate(labels map[string]string) bool {
+func (node OrNode) EvaluateFunc(get func(key string) (string, bool)) bool {
 	for _, operand := range node.Operands {
-		if operand.Evaluate(labels) {
+		if operand.EvaluateFunc(get) {
 			return true
 		}
 	}
@@ -242,23 +922,56 @@ func (node OrNode) Evaluate(labels map[string]string) bool {
 }
 
 func (node OrNode) collectFragments(fragments []string) []string {
-	fragments = append(fragments, "(")
+	// "||" has the lowest precedence so its operands never need parentheses.
 	fragments = node.Operands[0].collectFragments(fragments)
 	for _, op := range node.Operands[1:] {
 		fragments = append(fragments, " || ")
 		fragments = op.collectFragments(fragments)
 	}
-	fragments = append(fragments, ")")
 	return fragments
 }
 
+// collectParenthesizedFragments appends the fragments of the node, wrapped in
+// parentheses.  The canonical form only includes parentheses where they are
+// needed to preserve precedence.
+func collectParenthesizedFragments(fragments []string, n Node) []string {
+	fragments = append(fragments, "(")
+	fragments = n.collectFragments(fragments)
+	return append(fragments, ")")
+}
+
+func (node OrNode) collectLabelKeys(keys map[string]bool) {
+	for _, op := range node.Operands {
+		op.collectLabelKeys(keys)
+	}
+}
+
 type AllNode struct {
 }
 
-func (node AllNode) Evaluate(labels map[string]string) bool {
+func (node AllNode) EvaluateFunc(get func(key string) (string, bool)) bool {
 	return true
 }
 
 func (node AllNode) collectFragments(fragments []string) []string {
 	return append(fragments, "all()")
 }
+
+func (node AllNode) collectLabelKeys(keys map[string]bool) {
+}
+
+// NoneNode matches nothing.  It is written "none()" and can be used, for
+// example, to disable a policy without deleting it.
+type NoneNode struct {
+}
+
+func (node NoneNode) EvaluateFunc(get func(key string) (string, bool)) bool {
+	return false
+}
+
+func (node NoneNode) collectFragments(fragments []string) []string {
+	return append(fragments, "none()")
+}
+
+func (node NoneNode) collectLabelKeys(keys map[string]bool) {
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import "fmt"
+
+// AndSelectors returns a Selector that matches only if all of the given
+// selectors match.  The result is built directly from the selectors' parsed
+// expressions and is equivalent to parsing "(sel1) && (sel2) && ...".  With
+// no selectors, the result is all().  Selectors that were not created by this
+// package are re-parsed from their string form, and an error is returned if
+// that fails.
+//
+// (AndSelectors and OrSelectors are not simply And and Or because those names
+// would clash with the Gomega matchers when both packages are dot-imported.)
+func AndSelectors(sels ...Selector) (Selector, error) {
+	switch len(sels) {
+	case 0:
+		return selectorRoot{root: AllNode{}}, nil
+	case 1:
+		root, err := rootNode(sels[0])
+		if err != nil {
+			return nil, err
+		}
+		return selectorRoot{root: root}, nil
+	}
+	nodes, err := rootNodes(sels)
+	if err != nil {
+		return nil, err
+	}
+	return selectorRoot{root: AndNode{nodes}}, nil
+}
+
+// OrSelectors returns a Selector that matches if any of the given selectors match.
+// The result is built directly from the selectors' parsed expressions and is
+// equivalent to parsing "(sel1) || (sel2) || ...".  With no selectors, the
+// result is none().  As for AndSelectors, an error is returned if a selector
+// from outside this package fails to re-parse.
+func OrSelectors(sels ...Selector) (Selector, error) {
+	switch len(sels) {
+	case 0:
+		return selectorRoot{root: NoneNode{}}, nil
+	case 1:
+		root, err := rootNode(sels[0])
+		if err != nil {
+			return nil, err
+		}
+		return selectorRoot{root: root}, nil
+	}
+	nodes, err := rootNodes(sels)
+	if err != nil {
+		return nil, err
+	}
+	return selectorRoot{root: OrNode{nodes}}, nil
+}
+
+// Negate returns a Selector that matches exactly when this one does not.  Its
+// String() is the canonical negated form, so negating a negation, such as
+// "!has(a)", unwraps it rather than adding a second "!", and negating all()
+// gives "!all()", which matches nothing.
+func (sel selectorRoot) Negate() Selector {
+	if not, ok := sel.root.(NotNode); ok {
+		return selectorRoot{root: not.Operand}
+	}
+	return selectorRoot{root: NotNode{sel.root}}
+}
+
+func rootNodes(sels []Selector) ([]Node, error) {
+	nodes := make([]Node, len(sels))
+	for i, sel := range sels {
+		node, err := rootNode(sel)
+		if err != nil {
+			return nil, err
+		}
+		nodes[i] = node
+	}
+	return nodes, nil
+}
+
+// rootNode returns the parsed expression of the selector.  Selectors that
+// were not created by this package are re-parsed from their string form.
+func rootNode(sel Selector) (Node, error) {
+	if root, ok := sel.(selectorRoot); ok {
+		return root.root, nil
+	}
+	parsed, err := Parse(sel.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse selector %q: %v", sel.String(), err)
+	}
+	return parsed.(selectorRoot).root, nil
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+// Equal returns true if the other selector has the same canonical form, and
+// hence the same UniqueId, as this one.
+func (sel selectorRoot) Equal(other Selector) bool {
+	return other != nil && sel.String() == other.String()
+}
+
+// Implies returns true if every set of labels that matches this selector
+// also matches the other.  It is best-effort: it recognises cases such as
+// `a == "b" && c == "d"` implying `a == "b"` by comparing the terms of "&&"
+// and "||" expressions, but it may return false negatives for more complex
+// expressions, for example where it would need to reason about the values
+// in the terms.  It never returns a false positive, so it returns false if
+// the other selector was not created by this package and fails to re-parse.
+func (sel selectorRoot) Implies(other Selector) bool {
+	if other == nil {
+		return false
+	}
+	otherRoot, err := rootNode(other)
+	if err != nil {
+		return false
+	}
+	return nodeImplies(simplifyNode(sel.root), simplifyNode(otherRoot))
+}
+
+func nodeImplies(a, b Node) bool {
+	if _, ok := b.(AllNode); ok {
+		return true
+	}
+	if isNoneNode(a) {
+		return true
+	}
+	if or, ok := a.(OrNode); ok {
+		for _, op := range or.Operands {
+			if !nodeImplies(op, b) {
+				return false
+			}
+		}
+		return true
+	}
+	switch b := b.(type) {
+	case AndNode:
+		for _, op := range b.Operands {
+			if !nodeImplies(a, op) {
+				return false
+			}
+		}
+		return true
+	case OrNode:
+		for _, op := range b.Operands {
+			if nodeImplies(a, op) {
+				return true
+			}
+		}
+	}
+	// Otherwise, a implies b if one of a's conjuncts does.
+	if and, ok := a.(AndNode); ok {
+		for _, op := range and.Operands {
+			if nodeImplies(op, b) {
+				return true
+			}
+		}
+		return false
+	}
+	return fragmentString(a) == fragmentString(b)
+}
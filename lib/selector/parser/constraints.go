@@ -0,0 +1,71 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import "sort"
+
+// ConstantConstraints returns, for a selector that is a conjunction of
+// `label == "value"` and `label in {...}` terms, the values that each label
+// must take for the selector to match, as a map from label key to the sorted
+// list of permitted values.  Repeated terms on the same label are intersected,
+// which may leave an empty list.  all() is the empty conjunction and gives an
+// empty map.  The bool is false, and the map nil, if the selector cannot be
+// expressed this way, for example because it uses "||", "!" or any other
+// operator.
+func (sel selectorRoot) ConstantConstraints() (map[string][]string, bool) {
+	var terms []Node
+	switch root := simplifyNode(sel.root).(type) {
+	case AndNode:
+		terms = root.Operands
+	case AllNode:
+	default:
+		terms = []Node{root}
+	}
+
+	valueSets := make(map[string]map[string]bool)
+	for _, term := range terms {
+		var key string
+		var values map[string]bool
+		switch term := term.(type) {
+		case LabelEqValueNode:
+			key, values = term.LabelName, map[string]bool{term.Value: true}
+		case LabelInSetNode:
+			key, values = term.LabelName, term.Value
+		default:
+			return nil, false
+		}
+		if existing, ok := valueSets[key]; ok {
+			intersection := make(map[string]bool)
+			for value := range existing {
+				if values[value] {
+					intersection[value] = true
+				}
+			}
+			values = intersection
+		}
+		valueSets[key] = values
+	}
+
+	constraints := make(map[string][]string, len(valueSets))
+	for key, values := range valueSets {
+		sorted := make([]string, 0, len(values))
+		for value := range values {
+			sorted = append(sorted, value)
+		}
+		sort.Strings(sorted)
+		constraints[key] = sorted
+	}
+	return constraints, true
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Explain evaluates the selector against the given labels and, if it does not
+// match, returns a human-readable trace of the sub-expressions that failed,
+// for example `a == "b" failed: a was "c"`.  The trace is empty on a match.
+func (sel selectorRoot) Explain(labels map[string]string) (bool, string) {
+	return explainNode(sel.root, LabelsGetter(labels))
+}
+
+// explainNode evaluates the node and explains the reason for any failure.
+func explainNode(n Node, get func(key string) (string, bool)) (bool, string) {
+	switch n := n.(type) {
+	case AllNode:
+		return true, ""
+	case NoneNode:
+		return false, "none() matches nothing"
+	case AndNode:
+		// The first failing operand is enough to explain an "&&".
+		for _, op := range n.Operands {
+			if ok, reason := explainNode(op, get); !ok {
+				return false, reason
+			}
+		}
+		return true, ""
+	case OrNode:
+		// An "||" only fails if every operand fails so report them all.
+		reasons := make([]string, 0, len(n.Operands))
+		for _, op := range n.Operands {
+			ok, reason := explainNode(op, get)
+			if ok {
+				return true, ""
+			}
+			reasons = append(reasons, reason)
+		}
+		return false, strings.Join(reasons, "; ")
+	case HasProfileNode:
+		if n.EvaluateFunc(get) {
+			return true, ""
+		}
+		return false, fmt.Sprintf("%s failed: profile %q was not present",
+			fragmentString(n), n.ProfileID)
+	case HasPrefixNode:
+		if n.EvaluateFunc(get) {
+			return true, ""
+		}
+		return false, fmt.Sprintf("%s failed: no label starting with %q was present",
+			fragmentString(n), n.Prefix)
+	case NotNode:
+		if n.Operand.EvaluateFunc(get) {
+			return false, fmt.Sprintf("%s failed: %s matched",
+				fragmentString(n), fragmentString(n.Operand))
+		}
+		return true, ""
+	default:
+		if n.EvaluateFunc(get) {
+			return true, ""
+		}
+		// The remaining node types test a single label or, for set
+		// literals with label references, a few labels.
+		keySet := make(map[string]bool)
+		n.collectLabelKeys(keySet)
+		keys := make([]string, 0, len(keySet))
+		for key := range keySet {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		reasons := make([]string, 0, len(keys))
+		for _, key := range keys {
+			if val, ok := get(key); ok {
+				reasons = append(reasons, fmt.Sprintf("%s was %q", key, val))
+			} else {
+				reasons = append(reasons, fmt.Sprintf("%s was not present", key))
+			}
+		}
+		return false, fmt.Sprintf("%s failed: %s", fragmentString(n), strings.Join(reasons, ", "))
+	}
+}
+
+// fragmentString returns the canonical string form of a single node.
+func fragmentString(n Node) string {
+	return strings.Join(n.collectFragments([]string{}), "")
+}
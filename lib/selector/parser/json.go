@@ -0,0 +1,57 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"encoding/json"
+)
+
+// MarshalJSON encodes the selector as its canonical string.
+func (sel selectorRoot) MarshalJSON() ([]byte, error) {
+	return json.Marshal(sel.String())
+}
+
+// JSONSelector wraps a Selector for use as a struct field that is decoded
+// from JSON, which is not possible with a field of the Selector interface
+// type.  It is encoded as the selector's canonical string and parsed when
+// decoded; decoding fails if the string is not a valid selector.  A JSON null
+// corresponds to a nil Selector.
+type JSONSelector struct {
+	Selector
+}
+
+func (sel JSONSelector) MarshalJSON() ([]byte, error) {
+	if sel.Selector == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(sel.Selector.String())
+}
+
+func (sel *JSONSelector) UnmarshalJSON(b []byte) error {
+	var s *string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if s == nil {
+		sel.Selector = nil
+		return nil
+	}
+	parsed, err := Parse(*s)
+	if err != nil {
+		return err
+	}
+	sel.Selector = parsed
+	return nil
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+// EvaluateMulti evaluates the selector against labels that may each have
+// several values.  Positive tests, such as `a == "b"`, `a in {...}` and
+// `a > 1`, match if any of the label's values matches, whereas the negated
+// tests `a != "b"`, `a not in {...}` require every value to differ.  has(a)
+// matches if the label is present, even with no values.  A label referenced
+// from a set literal, as in `a in {b}`, contributes all of its values to the
+// set.  A label with a single value behaves exactly as it does in Evaluate.
+func (sel selectorRoot) EvaluateMulti(labels map[string][]string) bool {
+	return evaluateMultiNode(sel.root, labels)
+}
+
+func evaluateMultiNode(n Node, labels map[string][]string) bool {
+	switch n := n.(type) {
+	case AndNode:
+		for _, op := range n.Operands {
+			if !evaluateMultiNode(op, labels) {
+				return false
+			}
+		}
+		return true
+	case OrNode:
+		for _, op := range n.Operands {
+			if evaluateMultiNode(op, labels) {
+				return true
+			}
+		}
+		return false
+	case NotNode:
+		return !evaluateMultiNode(n.Operand, labels)
+	case HasNode:
+		_, ok := labels[n.LabelName]
+		return ok
+	case LabelNeValueNode:
+		return evaluateEachValue(n, n.LabelName, labels, true)
+	case LabelNeBoolNode:
+		return evaluateEachValue(n, n.LabelName, labels, true)
+	case LabelNotInSetNode:
+		return evaluateEachValue(n, n.LabelName, labels, true)
+	case LabelNotInNumberSetNode:
+		return evaluateEachValue(n, n.LabelName, labels, true)
+	case LabelInRefSetNode:
+		return evaluateEachValue(LabelInSetNode{n.LabelName, refSetValues(n.Value, n.Refs, labels)},
+			n.LabelName, labels, false)
+	case LabelNotInRefSetNode:
+		return evaluateEachValue(LabelNotInSetNode{n.LabelName, refSetValues(n.Value, n.Refs, labels)},
+			n.LabelName, labels, true)
+	}
+
+	// Each of the remaining label tests reads exactly one label and matches
+	// if any of its values matches.
+	keys := make(map[string]bool)
+	n.collectLabelKeys(keys)
+	for key := range keys {
+		return evaluateEachValue(n, key, labels, false)
+	}
+
+	// Nodes that don't test a single label, such as all() and has_prefix(),
+	// only care which labels are present.
+	firstValues := make(map[string]string, len(labels))
+	for key, values := range labels {
+		if len(values) > 0 {
+			firstValues[key] = values[0]
+		} else {
+			firstValues[key] = ""
+		}
+	}
+	return n.EvaluateFunc(LabelsGetter(firstValues))
+}
+
+// evaluateEachValue evaluates the node, which tests the given label, against
+// each of the label's values in turn.  If all is true, the node must match
+// every value; otherwise, it must match at least one.  A missing label is
+// evaluated as in Evaluate.
+func evaluateEachValue(n Node, key string, labels map[string][]string, all bool) bool {
+	values, ok := labels[key]
+	if !ok {
+		return n.EvaluateFunc(func(string) (string, bool) {
+			return "", false
+		})
+	}
+	for _, value := range values {
+		value := value
+		match := n.EvaluateFunc(func(k string) (string, bool) {
+			if k != key {
+				return "", false
+			}
+			return value, true
+		})
+		if match != all {
+			return match
+		}
+	}
+	return all
+}
+
+// refSetValues returns the set of values that a set literal with label
+// references stands for: its literal values along with every value of each of
+// the referenced labels.
+func refSetValues(set map[string]bool, refs map[string]bool, labels map[string][]string) map[string]bool {
+	values := make(map[string]bool, len(set))
+	for value := range set {
+		values[value] = true
+	}
+	for ref := range refs {
+		for _, value := range labels[ref] {
+			values[value] = true
+		}
+	}
+	return values
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import "sort"
+
+// Operators returns the sorted set of operators and functions that the
+// selector uses, named as they are written in selector syntax: for example
+// "==", "not in", "has", "has_profile", "all", "!", "&&" and "||".  Set
+// membership tests are named "in" or "not in" whether the set holds strings or
+// numbers.  An empty selector uses "all".
+func (sel selectorRoot) Operators() []string {
+	opSet := make(map[string]bool)
+	transformNode(sel.root, func(n Node) Node {
+		opSet[nodeOperator(n)] = true
+		return n
+	})
+	ops := make([]string, 0, len(opSet))
+	for op := range opSet {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+// nodeOperator returns the name of the operator or function applied by the
+// node.
+func nodeOperator(n Node) string {
+	switch n.(type) {
+	case LabelEqValueNode, LabelEqBoolNode:
+		return "=="
+	case LabelNeValueNode, LabelNeBoolNode:
+		return "!="
+	case LabelIEqValueNode:
+		return "iequals"
+	case LabelRegexNode:
+		return "=~"
+	case LabelContainsNode:
+		return "contains"
+	case LabelInSetNode, LabelInNumberSetNode, LabelInRefSetNode:
+		return "in"
+	case LabelNotInSetNode, LabelNotInNumberSetNode, LabelNotInRefSetNode:
+		return "not in"
+	case LabelLtValueNode:
+		return "<"
+	case LabelLeValueNode:
+		return "<="
+	case LabelGtValueNode:
+		return ">"
+	case LabelGeValueNode:
+		return ">="
+	case HasNode:
+		return "has"
+	case HasProfileNode:
+		return "has_profile"
+	case HasPrefixNode:
+		return "has_prefix"
+	case AllNode:
+		return "all"
+	case NoneNode:
+		return "none"
+	case NotNode:
+		return "!"
+	case AndNode:
+		return "&&"
+	case OrNode:
+		return "||"
+	}
+	// Unreachable: Node's unexported methods mean that every node is one
+	// of the types above.
+	return ""
+}
@@ -17,16 +17,141 @@ package parser
 import (
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/golang/glog"
 	. "github.com/tigera/libcalico-go/lib/selector/tokenizer"
 )
 
+// ParseError is returned by Parse if the selector is invalid.  It records
+// where in the selector the problem was found.
+type ParseError struct {
+	// Offset is the byte offset of the offending token in the selector.
+	Offset int
+	// Token is the text of the offending token or the empty string if
+	// the selector ended unexpectedly.
+	Token string
+	Msg   string
+}
+
+func (e ParseError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("unexpected end of selector at offset %d: %s", e.Offset, e.Msg)
+	}
+	return fmt.Sprintf("unexpected '%s' at offset %d: %s", e.Token, e.Offset, e.Msg)
+}
+
+// syntaxError is the internal form of a ParseError, which records the
+// position of the offending token as the tokens that remained to be parsed,
+// starting with the offending token.
+type syntaxError struct {
+	remTokens []Token
+	msg       string
+}
+
+func (e syntaxError) Error() string {
+	return e.msg
+}
+
+// newParseError creates a ParseError for the token at the given index.
+func newParseError(selector string, offsets []int, index int, msg string) ParseError {
+	if index >= len(offsets) || index == len(offsets)-1 {
+		// Past the last real token; the final offset is that of the
+		// end of the string.
+		return ParseError{Offset: len(selector), Msg: msg}
+	}
+	start := offsets[index]
+	token := strings.TrimRight(selector[start:offsets[index+1]], " \t")
+	return ParseError{Offset: start, Token: token, Msg: msg}
+}
+
+// tokenAt returns the character at the given offset in the selector, for
+// reporting errors from the tokenizer.
+func tokenAt(selector string, offset int) string {
+	if offset >= len(selector) {
+		return ""
+	}
+	_, size := utf8.DecodeRuneInString(selector[offset:])
+	return selector[offset : offset+size]
+}
+
+// boolLiteral returns the value of a bare true or false, which the tokenizer
+// sees as a label.
+func boolLiteral(token Token) (value bool, ok bool) {
+	if token.Kind != TokLabel {
+		return false, false
+	}
+	switch token.Value.(string) {
+	case "true":
+		return true, true
+	case "false":
+		return false, true
+	}
+	return false, false
+}
+
+// DefaultMaxNestingDepth is the maximum depth of nested parentheses accepted
+// by Parse.  It is far deeper than any realistic selector but prevents a
+// maliciously deep selector from exhausting the stack.
+const DefaultMaxNestingDepth = 100
+
 // Parse a string representation of a selector expression into a Selector.
 func Parse(selector string) (sel Selector, err error) {
+	return ParseWithMaxNestingDepth(selector, DefaultMaxNestingDepth)
+}
+
+// ParseLenient is like Parse but, rather than failing outright on a selector
+// that it can't parse, for example because it uses an operator or function
+// added in a later version, it returns the parse error along with a
+// placeholder selector.  The placeholder matches everything if matchOnError
+// is true and nothing (it is none()) otherwise, so that a policy with an
+// unsupported selector can be degraded rather than treated as fatal.
+func ParseLenient(selector string, matchOnError bool) (Selector, error) {
+	sel, err := Parse(selector)
+	if err == nil {
+		return sel, nil
+	}
+	placeholder := selectorRoot{root: NoneNode{}}
+	if matchOnError {
+		placeholder = selectorRoot{root: AllNode{}}
+	}
+	glog.Warningf("Failed to parse selector %#v, using %v in its place: %v",
+		selector, placeholder.String(), err)
+	return placeholder, err
+}
+
+// ErrEmptyInput is returned by ParseReader if the reader yields no data at
+// all.  Input consisting only of whitespace is parsed, as by Parse, as
+// "all()".
+var ErrEmptyInput = errors.New("selector input is empty")
+
+// ParseReader reads the whole of r and parses it as a selector, exactly as
+// Parse does.  It fails if reading fails or with ErrEmptyInput if there is
+// nothing to read.  The input is not trimmed, so, as for Parse, line breaks,
+// including a trailing newline, are syntax errors.
+func ParseReader(r io.Reader) (Selector, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read selector: %v", err)
+	}
+	if len(data) == 0 {
+		return nil, ErrEmptyInput
+	}
+	return Parse(string(data))
+}
+
+// ParseWithMaxNestingDepth is like Parse but returns an error for selectors
+// that nest parentheses more than maxDepth deep.
+func ParseWithMaxNestingDepth(selector string, maxDepth int) (sel Selector, err error) {
 	glog.V(3).Infof("Parsing %#v", selector)
-	tokens, err := Tokenize(selector)
+	tokens, offsets, err := TokenizeWithOffsets(selector)
 	if err != nil {
+		tokErr := err.(Error)
+		err = ParseError{Offset: tokErr.Offset, Token: tokenAt(selector, tokErr.Offset), Msg: tokErr.Msg}
 		return
 	}
 	if tokens[0].Kind == TokEof {
@@ -34,12 +159,16 @@ func Parse(selector string) (sel Selector, err error) {
 	}
 	glog.V(4).Infof("Tokens %v", tokens)
 	// The "||" operator has the lowest precedence so we start with that.
-	node, remTokens, err := parseOrExpression(tokens)
-	if err != nil {
-		return
+	node, remTokens, err := parseOrExpression(tokens, maxDepth)
+	if err == nil && len(remTokens) != 1 {
+		err = syntaxError{remTokens, "unexpected content at end of selector"}
 	}
-	if len(remTokens) != 1 {
-		err = errors.New(fmt.Sprint("unexpected content at end of selector ", remTokens))
+	if err != nil {
+		if synErr, ok := err.(syntaxError); ok {
+			// Convert the position of the bad token into an offset
+			// into the selector string.
+			err = newParseError(selector, offsets, len(tokens)-len(synErr.remTokens), synErr.msg)
+		}
 		return
 	}
 	sel = selectorRoot{root: node}
@@ -47,11 +176,12 @@ func Parse(selector string) (sel Selector, err error) {
 }
 
 // parseOrExpression parses a one or more "&&" terms, separated by "||" operators.
-func parseOrExpression(tokens []Token) (sel node, remTokens []Token, err error) {
+// depth is the number of further levels of parentheses that may be nested.
+func parseOrExpression(tokens []Token, depth int) (sel Node, remTokens []Token, err error) {
 	glog.V(5).Infof("Parsing ||s from %v", tokens)
 	// Look for the first expression.
-	andNodes := make([]node, 0)
-	sel, remTokens, err = parseAndExpression(tokens)
+	andNodes := make([]Node, 0)
+	sel, remTokens, err = parseAndExpression(tokens, depth)
 	if err != nil {
 		return
 	}
@@ -62,7 +192,7 @@ func parseOrExpression(tokens []Token) (sel node, remTokens []Token, err error)
 		switch remTokens[0].Kind {
 		case TokOr:
 			remTokens = remTokens[1:]
-			sel, remTokens, err = parseAndExpression(remTokens)
+			sel, remTokens, err = parseAndExpression(remTokens, depth)
 			if err != nil {
 				return
 			}
@@ -79,11 +209,11 @@ func parseOrExpression(tokens []Token) (sel node, remTokens []Token, err error)
 }
 
 // parseAndExpression parses a one or more operations, separated by "&&" operators.
-func parseAndExpression(tokens []Token) (sel node, remTokens []Token, err error) {
+func parseAndExpression(tokens []Token, depth int) (sel Node, remTokens []Token, err error) {
 	glog.V(5).Infof("Parsing &&s from %v", tokens)
 	// Look for the first operation.
-	opNodes := make([]node, 0)
-	sel, remTokens, err = parseOperation(tokens)
+	opNodes := make([]Node, 0)
+	sel, remTokens, err = parseOperation(tokens, depth)
 	if err != nil {
 		return
 	}
@@ -94,7 +224,7 @@ func parseAndExpression(tokens []Token) (sel node, remTokens []Token, err error)
 		switch remTokens[0].Kind {
 		case TokAnd:
 			remTokens = remTokens[1:]
-			sel, remTokens, err = parseOperation(remTokens)
+			sel, remTokens, err = parseOperation(remTokens, depth)
 			if err != nil {
 				return
 			}
@@ -110,12 +240,12 @@ func parseAndExpression(tokens []Token) (sel node, remTokens []Token, err error)
 	}
 }
 
-// parseOperations parses a single, possibly negated operation (i.e. ==, !=, has()).
+// parseOperations parses a single, possibly negated operation (i.e. ==, !=, <, has()).
 // It also handles calling parseOrExpression recursively for parenthesized expressions.
-func parseOperation(tokens []Token) (sel node, remTokens []Token, err error) {
+func parseOperation(tokens []Token, depth int) (sel Node, remTokens []Token, err error) {
 	glog.V(5).Infof("Parsing op from %v", tokens)
 	if len(tokens) == 0 {
-		err = errors.New("Unexpected end of string looking for op")
+		err = syntaxError{tokens, "Unexpected end of string looking for op"}
 		return
 	}
 
@@ -135,13 +265,30 @@ func parseOperation(tokens []Token) (sel node, remTokens []Token, err error) {
 	case TokHas:
 		sel = HasNode{tokens[0].Value.(string)}
 		remTokens = tokens[1:]
+	case TokHasProfile:
+		if tokens[1].Kind != TokStringLiteral {
+			err = syntaxError{tokens[1:], "Expected string"}
+			return
+		}
+		if tokens[2].Kind != TokRParen {
+			err = syntaxError{tokens[2:], "Expected )"}
+			return
+		}
+		sel = HasProfileNode{tokens[1].Value.(string)}
+		remTokens = tokens[3:]
+	case TokHasPrefix:
+		sel = HasPrefixNode{tokens[0].Value.(string)}
+		remTokens = tokens[1:]
 	case TokAll:
 		sel = AllNode{}
 		remTokens = tokens[1:]
+	case TokNone:
+		sel = NoneNode{}
+		remTokens = tokens[1:]
 	case TokLabel:
 		// should have an operator and a literal.
 		if len(tokens) < 3 {
-			err = errors.New(fmt.Sprint("Unexpected end of string in middle of op", tokens))
+			err = syntaxError{tokens[len(tokens)-1:], "Unexpected end of string in middle of op"}
 			return
 		}
 		switch tokens[1].Kind {
@@ -149,71 +296,186 @@ func parseOperation(tokens []Token) (sel node, remTokens []Token, err error) {
 			if tokens[2].Kind == TokStringLiteral {
 				sel = LabelEqValueNode{tokens[0].Value.(string), tokens[2].Value.(string)}
 				remTokens = tokens[3:]
+			} else if value, ok := boolLiteral(tokens[2]); ok {
+				sel = LabelEqBoolNode{tokens[0].Value.(string), value}
+				remTokens = tokens[3:]
 			} else {
-				err = errors.New("Expected string")
+				err = syntaxError{tokens[2:], "Expected string"}
 			}
 		case TokNe:
 			if tokens[2].Kind == TokStringLiteral {
 				sel = LabelNeValueNode{tokens[0].Value.(string), tokens[2].Value.(string)}
 				remTokens = tokens[3:]
+			} else if value, ok := boolLiteral(tokens[2]); ok {
+				sel = LabelNeBoolNode{tokens[0].Value.(string), value}
+				remTokens = tokens[3:]
+			} else {
+				err = syntaxError{tokens[2:], "Expected string"}
+			}
+		case TokIEq:
+			if tokens[2].Kind == TokStringLiteral {
+				sel = LabelIEqValueNode{tokens[0].Value.(string), tokens[2].Value.(string)}
+				remTokens = tokens[3:]
 			} else {
-				err = errors.New("Expected string")
+				err = syntaxError{tokens[2:], "Expected string"}
+			}
+		case TokContains:
+			if tokens[2].Kind != TokStringLiteral {
+				err = syntaxError{tokens[2:], "Expected string"}
+				return
+			}
+			// An optional "sep" clause overrides the default separator.
+			node := LabelContainsNode{tokens[0].Value.(string), tokens[2].Value.(string), DefaultContainsSeparator}
+			remTokens = tokens[3:]
+			if remTokens[0].Kind == TokLabel && remTokens[0].Value.(string) == "sep" {
+				if remTokens[1].Kind != TokStringLiteral {
+					err = syntaxError{remTokens[1:], "Expected string"}
+					return
+				}
+				if remTokens[1].Value.(string) == "" {
+					err = syntaxError{remTokens[1:], "Separator must not be empty"}
+					return
+				}
+				node.Separator = remTokens[1].Value.(string)
+				remTokens = remTokens[2:]
+			}
+			sel = node
+		case TokRegex:
+			if tokens[2].Kind != TokStringLiteral {
+				err = syntaxError{tokens[2:], "Expected string"}
+				return
 			}
+			// Compile the regex once, up front, so that evaluation is cheap.
+			var regex *regexp.Regexp
+			regex, err = regexp.Compile(tokens[2].Value.(string))
+			if err != nil {
+				err = syntaxError{tokens[2:], fmt.Sprint("Invalid regex: ", err)}
+				return
+			}
+			sel = LabelRegexNode{tokens[0].Value.(string), regex}
+			remTokens = tokens[3:]
+		case TokLt, TokLe, TokGt, TokGe:
+			if tokens[2].Kind != TokNumber {
+				err = syntaxError{tokens[2:], "Expected number"}
+				return
+			}
+			labelName := tokens[0].Value.(string)
+			value := tokens[2].Value.(float64)
+			switch tokens[1].Kind {
+			case TokLt:
+				sel = LabelLtValueNode{labelName, value}
+			case TokLe:
+				sel = LabelLeValueNode{labelName, value}
+			case TokGt:
+				sel = LabelGtValueNode{labelName, value}
+			case TokGe:
+				sel = LabelGeValueNode{labelName, value}
+			}
+			remTokens = tokens[3:]
 		case TokIn, TokNotIn:
 			if tokens[2].Kind == TokLBrace {
 				remTokens = tokens[3:]
 				set := make(map[string]bool)
+				numberSet := make(map[float64]bool)
+				// Bare labels in the set refer to the values of those
+				// labels.
+				refs := make(map[string]bool)
+				// The first member whose type can't be mixed with the
+				// members before it, if any.  Label references may be
+				// mixed with strings but not with numbers.
+				var mixedAt []Token
+				var mixedMsg string
 				for {
-					if remTokens[0].Kind == TokStringLiteral {
+					kind := remTokens[0].Kind
+					if kind == TokStringLiteral {
 						set[remTokens[0].Value.(string)] = true
-						remTokens = remTokens[1:]
-						if remTokens[0].Kind == TokComma {
-							remTokens = remTokens[1:]
-						} else {
-							break
+					} else if kind == TokNumber {
+						numberSet[remTokens[0].Value.(float64)] = true
+					} else if kind == TokLabel {
+						refs[remTokens[0].Value.(string)] = true
+					} else {
+						break
+					}
+					if mixedAt == nil && len(numberSet) > 0 {
+						if len(refs) > 0 {
+							mixedAt = remTokens
+							mixedMsg = "Set literal mixes numbers and label references"
+						} else if len(set) > 0 {
+							mixedAt = remTokens
+							mixedMsg = "Set literal mixes strings and numbers"
 						}
+					}
+					remTokens = remTokens[1:]
+					if remTokens[0].Kind == TokComma {
+						remTokens = remTokens[1:]
 					} else {
 						break
 					}
 				}
-				if remTokens[0].Kind != TokRBrace {
-					err = errors.New("Expected }")
+				if mixedAt != nil {
+					err = syntaxError{mixedAt, mixedMsg}
+				} else if remTokens[0].Kind != TokRBrace {
+					err = syntaxError{remTokens, "Expected }"}
 				} else {
 					// Skip over the }
 					remTokens = remTokens[1:]
 
-					if tokens[1].Kind == TokIn {
-						sel = LabelInSetNode{tokens[0].Value.(string), set}
-					} else {
-						sel = LabelNotInSetNode{tokens[0].Value.(string), set}
+					labelName := tokens[0].Value.(string)
+					switch {
+					case len(numberSet) > 0 && tokens[1].Kind == TokIn:
+						sel = LabelInNumberSetNode{labelName, numberSet}
+					case len(numberSet) > 0:
+						sel = LabelNotInNumberSetNode{labelName, numberSet}
+					case len(refs) > 0 && tokens[1].Kind == TokIn:
+						sel = LabelInRefSetNode{labelName, set, refs}
+					case len(refs) > 0:
+						sel = LabelNotInRefSetNode{labelName, set, refs}
+					case tokens[1].Kind == TokIn:
+						sel = LabelInSetNode{labelName, set}
+					default:
+						sel = LabelNotInSetNode{labelName, set}
 					}
 				}
 			} else {
-				err = errors.New("Expected set literal")
+				err = syntaxError{tokens[2:], "Expected set literal"}
 			}
+		case TokLParen:
+			// Most likely a function that this version doesn't
+			// support.
+			err = syntaxError{tokens, fmt.Sprintf("Unknown function %s()", tokens[0].Value)}
 		default:
-			err = errors.New(fmt.Sprint("Expected == or != not ", tokens[1]))
+			err = syntaxError{tokens[1:], "Expected comparison operator"}
 			return
 		}
 	case TokLParen:
 		// We hit a paren, skip past it, then recurse.
-		sel, remTokens, err = parseOrExpression(tokens[1:])
+		if depth <= 0 {
+			err = syntaxError{tokens, "Selector is nested too deeply"}
+			return
+		}
+		sel, remTokens, err = parseOrExpression(tokens[1:], depth-1)
 		if err != nil {
 			return
 		}
 		// After parsing the nested expression, there should be
 		// a matching paren.
 		if len(remTokens) < 1 || remTokens[0].Kind != TokRParen {
-			err = errors.New("Expected )")
+			err = syntaxError{remTokens, "Expected )"}
 			return
 		}
 		remTokens = remTokens[1:]
 	default:
-		err = errors.New(fmt.Sprint("Unexpected token: ", tokens[0]))
+		err = syntaxError{tokens, "Unexpected token"}
 		return
 	}
 	if negated && err == nil {
-		sel = NotNode{sel}
+		if not, ok := sel.(NotNode); ok {
+			// A negated, parenthesized negation, such as "!(!has(a))";
+			// collapse the double negation as we do for "!!".
+			sel = not.Operand
+		} else {
+			sel = NotNode{sel}
+		}
 	}
 	return
 }
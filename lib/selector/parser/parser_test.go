@@ -17,7 +17,11 @@ package parser_test
 import (
 	. "github.com/tigera/libcalico-go/lib/selector/parser"
 
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
+	"strings"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -81,6 +85,20 @@ var selectorTests = []selectorTest{
 			{"a": `'`},
 		}},
 
+	// Empty sets...
+	{`a in {}`,
+		[]map[string]string{},
+		[]map[string]string{{}, {"a": ""}, {"a": "b"}, {"b": "c"}}},
+	{`a not in {}`,
+		[]map[string]string{{}, {"a": ""}, {"a": "b"}, {"b": "c"}},
+		[]map[string]string{}},
+	{`!a in {}`,
+		[]map[string]string{{}, {"a": "b"}},
+		[]map[string]string{}},
+	{`a in {} || b not in {}`,
+		[]map[string]string{{}, {"a": "b"}},
+		[]map[string]string{}},
+
 	// Tests copied from Python version.
 	{`a == 'a'`, []map[string]string{{"a": "a"}}, []map[string]string{}},
 	{`a == "a"`, []map[string]string{{"a": "a"}}, []map[string]string{}},
@@ -133,6 +151,191 @@ var selectorTests = []selectorTest{
 	{`a != 'a1' || b == 'b1'`, []map[string]string{{"a": "a1", "b": "b1"}}, []map[string]string{}},
 	{`a != 'a1' || b != 'b1'`, []map[string]string{}, []map[string]string{{"a": "a1", "b": "b1"}}},
 	{`! a == 'a1' || ! b == 'b1'`, []map[string]string{}, []map[string]string{{"a": "a1", "b": "b1"}}},
+
+	// Numeric comparisons...
+	{`a > 3`,
+		[]map[string]string{{"a": "4"}, {"a": "3.5"}, {"a": "100"}},
+		[]map[string]string{{}, {"a": "3"}, {"a": "-4"}, {"a": "four"}, {"a": ""}}},
+	{`a >= 3`,
+		[]map[string]string{{"a": "3"}, {"a": "3.0"}, {"a": "4"}},
+		[]map[string]string{{}, {"a": "2.9"}, {"a": "x"}}},
+	{`a < -1.5`,
+		[]map[string]string{{"a": "-2"}, {"a": "-1.6"}},
+		[]map[string]string{{}, {"a": "-1.5"}, {"a": "0"}, {"a": "-"}}},
+	{`a <= 8080`,
+		[]map[string]string{{"a": "8080"}, {"a": "80"}},
+		[]map[string]string{{}, {"a": "8081"}, {"a": "http"}}},
+	{`!a > 3`,
+		[]map[string]string{{}, {"a": "3"}, {"a": "abc"}},
+		[]map[string]string{{"a": "4"}}},
+	{`a > 1 && a < 5`,
+		[]map[string]string{{"a": "2"}, {"a": "4.99"}},
+		[]map[string]string{{"a": "1"}, {"a": "5"}, {"b": "3"}}},
+
+	// Case-insensitive equality...
+	{`env iequals "prod"`,
+		[]map[string]string{{"env": "prod"}, {"env": "Prod"}, {"env": "PROD"}, {"env": "pRoD", "a": "b"}},
+		[]map[string]string{{}, {"env": "production"}, {"env": "dev"}, {"Env": "prod"}, {"env": ""}}},
+	{`env iequals 'Prod'`,
+		[]map[string]string{{"env": "prod"}, {"env": "PROD"}},
+		[]map[string]string{{}, {"env": "prd"}}},
+	{`!env iequals "prod"`,
+		[]map[string]string{{}, {"env": "dev"}},
+		[]map[string]string{{"env": "PROD"}}},
+	{`env iequals "prod" && tier iequals "Web"`,
+		[]map[string]string{{"env": "PROD", "tier": "WEB"}},
+		[]map[string]string{{"env": "PROD"}, {"env": "PROD", "tier": "db"}}},
+	// ...which is only an operator after a label, so labels that were
+	// named "iequals" before it was added still work.
+	{`iequals == "x" && iequals-a iequals "Y"`,
+		[]map[string]string{{"iequals": "x", "iequals-a": "y"}},
+		[]map[string]string{{"iequals": "X", "iequals-a": "y"}, {"iequals": "x"}}},
+	{`has(iequals) && iequals.b != "c"`,
+		[]map[string]string{{"iequals": "", "iequals.b": "d"}},
+		[]map[string]string{{"iequals.b": "d"}, {"iequals": "", "iequals.b": "c"}}},
+
+	// Regex matches...
+	{`name =~ "^web-[0-9]+$"`,
+		[]map[string]string{{"name": "web-1"}, {"name": "web-042"}},
+		[]map[string]string{{}, {"name": "web-"}, {"name": "web-1a"}, {"name": "db-1"}, {"other": "web-1"}}},
+	{`name =~ "web"`,
+		[]map[string]string{{"name": "web"}, {"name": "my-web-server"}},
+		[]map[string]string{{}, {"name": "WEB"}}},
+	{`name =~ '(?i)^"?web'`,
+		[]map[string]string{{"name": "WEB"}, {"name": `"web"`}},
+		[]map[string]string{{}, {"name": "a-web"}}},
+	{`!name =~ "^web"`,
+		[]map[string]string{{}, {"name": "db"}},
+		[]map[string]string{{"name": "web"}}},
+
+	// Escaped quotes and backslashes in string literals...
+	{`a == "he said \"hi\""`,
+		[]map[string]string{{"a": `he said "hi"`}},
+		[]map[string]string{{}, {"a": `he said \"hi\"`}, {"a": "he said hi"}}},
+	{`a == 'it\'s "quoted"'`,
+		[]map[string]string{{"a": `it's "quoted"`}},
+		[]map[string]string{{}, {"a": `it\'s "quoted"`}}},
+	{`a in {"\"'", 'x\\'}`,
+		[]map[string]string{{"a": `"'`}, {"a": `x\`}},
+		[]map[string]string{{}, {"a": `x\\`}, {"a": `"`}}},
+	{`a == 'a\\b'`,
+		[]map[string]string{{"a": `a\b`}},
+		[]map[string]string{{}, {"a": `a\\b`}}},
+	{`a == "C:\\"`,
+		[]map[string]string{{"a": `C:\`}},
+		[]map[string]string{{}, {"a": `C:\\`}, {"a": "C:"}}},
+	{`a == "c:\temp"`,
+		[]map[string]string{{"a": `c:\temp`}},
+		[]map[string]string{{"a": `c:temp`}}},
+
+	// Numeric sets...
+	{`port in {80, 443, 8080}`,
+		[]map[string]string{{"port": "80"}, {"port": "443"}, {"port": "080"}, {"port": "8080.0"}},
+		[]map[string]string{{}, {"port": "81"}, {"port": "http"}, {"port": ""}, {"other": "80"}}},
+	{`port not in {80, 443}`,
+		[]map[string]string{{}, {"port": "81"}, {"port": "http"}, {"other": "80"}},
+		[]map[string]string{{"port": "80"}, {"port": "443.0"}}},
+	{`a in {-1.5, 2}`,
+		[]map[string]string{{"a": "-1.5"}, {"a": "2.00"}},
+		[]map[string]string{{"a": "1.5"}, {"a": "-2"}}},
+	{`!port in {80}`,
+		[]map[string]string{{}, {"port": "8080"}},
+		[]map[string]string{{"port": "80"}}},
+
+	// Comma-separated lists...
+	{`roles contains "web"`,
+		[]map[string]string{
+			{"roles": "web"},
+			{"roles": "web,api"},
+			{"roles": "api, web"},
+			{"roles": "db,web ,api"}},
+		[]map[string]string{
+			{},
+			{"roles": ""},
+			{"roles": "api"},
+			{"roles": "webserver,api"},
+			{"roles": "api,we"},
+			{"roles": "web;api"},
+			{"other": "web"}}},
+	{`roles contains "web" sep ";"`,
+		[]map[string]string{{"roles": "web;api"}, {"roles": "api; web"}},
+		[]map[string]string{{"roles": "web,api"}, {"roles": "webs;api"}}},
+	{`!roles contains "a b" sep " "`,
+		[]map[string]string{{}, {"roles": "a b"}},
+		[]map[string]string{}},
+	// "contains" is only an operator after a label.
+	{`contains-pii == "true" && contains contains "a"`,
+		[]map[string]string{{"contains-pii": "true", "contains": "b,a"}},
+		[]map[string]string{{"contains-pii": "true"}, {"contains": "a"}}},
+	{`has(contains.x) || contains/y in {"z"}`,
+		[]map[string]string{{"contains.x": ""}, {"contains/y": "z"}},
+		[]map[string]string{{}, {"contains": "z"}}},
+
+	// Matching nothing...
+	{`none()`,
+		[]map[string]string{},
+		[]map[string]string{{}, {"a": "b"}}},
+	{`!none()`,
+		[]map[string]string{{}, {"a": "b"}},
+		[]map[string]string{}},
+	{`none() || has(a)`,
+		[]map[string]string{{"a": "b"}},
+		[]map[string]string{{}, {"b": "a"}}},
+	{`none() && has(a)`,
+		[]map[string]string{},
+		[]map[string]string{{}, {"a": "b"}}},
+	{`none == "x"`,
+		[]map[string]string{{"none": "x"}},
+		[]map[string]string{{}}},
+
+	// Sets that reference other labels...
+	{`a in {b, c}`,
+		[]map[string]string{{"a": "x", "b": "x"}, {"a": "x", "b": "y", "c": "x"}, {"a": "", "c": ""}},
+		[]map[string]string{{}, {"a": "x"}, {"b": "x", "c": "x"}, {"a": "x", "b": "y"}, {"a": "b"}}},
+	{`a in {"x", b}`,
+		[]map[string]string{{"a": "x"}, {"a": "y", "b": "y"}},
+		[]map[string]string{{"b": "x"}, {"a": "b"}, {"a": "y", "b": "x"}}},
+	{`a not in {b, "x"}`,
+		[]map[string]string{{}, {"a": "y"}, {"a": "y", "b": "z"}, {"b": "x"}},
+		[]map[string]string{{"a": "x"}, {"a": "y", "b": "y"}}},
+	{`a in {a}`,
+		[]map[string]string{{"a": "x"}},
+		[]map[string]string{{}}},
+
+	// Bare booleans...
+	{`privileged == true`,
+		[]map[string]string{{"privileged": "true"}, {"privileged": "1"}, {"privileged": "True"}, {"privileged": "YES"}, {"privileged": "on"}},
+		[]map[string]string{{}, {"privileged": ""}, {"privileged": "false"}, {"privileged": "0"}, {"privileged": "y"}, {"true": "true"}}},
+	{`privileged == false`,
+		[]map[string]string{{"privileged": "false"}, {"privileged": "0"}, {"privileged": "No"}, {"privileged": "off"}},
+		[]map[string]string{{}, {"privileged": ""}, {"privileged": "true"}, {"privileged": "2"}}},
+	{`privileged != true`,
+		[]map[string]string{{}, {"privileged": ""}, {"privileged": "false"}, {"privileged": "maybe"}},
+		[]map[string]string{{"privileged": "true"}, {"privileged": "1"}}},
+	{`privileged != false && a == "true"`,
+		[]map[string]string{{"a": "true"}, {"a": "true", "privileged": "1"}},
+		[]map[string]string{{"a": "1"}, {"a": "true", "privileged": "0"}}},
+	{`true == true`,
+		[]map[string]string{{"true": "true"}},
+		[]map[string]string{{}, {"true": "false"}}},
+
+	// Label key prefixes...
+	{`has_prefix(projectcalico.org/)`,
+		[]map[string]string{
+			{"projectcalico.org/": ""},
+			{"projectcalico.org/namespace": "default"},
+			{"a": "b", "projectcalico.org/orchestrator": "k8s"}},
+		[]map[string]string{
+			{},
+			{"a": "projectcalico.org/"},
+			{"projectcalico.org": "a"},
+			{"example.com/projectcalico.org/a": "b"}}},
+	{`!has_prefix(k8s.io/) && a == "b"`,
+		[]map[string]string{{"a": "b"}, {"a": "b", "k8s.io": "c"}},
+		[]map[string]string{{}, {"a": "b", "k8s.io/c": "d"}}},
+	{`has_prefix(a) || has_prefix(b)`,
+		[]map[string]string{{"a": ""}, {"abc": "d"}, {"bcd": "e"}},
+		[]map[string]string{{}, {"cab": "a"}}},
 }
 
 var badSelectors = []string{
@@ -159,6 +362,36 @@ var badSelectors = []string{
 	`a == "b" || %`,  // Unexpected char
 	`a `,             // should be followed by operator
 	`has(foo) &&`,    // should be followed by operator
+	`a > "3"`,        // numeric operator with string literal
+	`a == 3`,         // equality with numeric literal
+	`a <`,            // missing number
+	`3 < a`,          // literal on lhs
+	`a > 3b`,         // malformed number
+	`a iequals 3`,    // case-insensitive equality with numeric literal
+	`a iequals`,      // missing literal
+	`iequals "a"`,    // missing label
+	`a =~ "("`,       // invalid regex
+	`a =~ "[a-"`,     // invalid regex
+	`a =~ 3`,         // regex must be a string
+	`a = "b"`,        // neither == nor =~
+	`a == "b\"`,      // escaped closing quote
+	`a == 'b\'`,      // escaped closing quote
+	`a in {,}`,       // set with missing member
+	`a in {`,         // unterminated set
+	`a not in {"a"`,  // unterminated set
+	`a in {1, "2"}`,  // mixed number and string set
+	`a in {"1", 2}`,  // mixed number and string set
+	`a in {b, 1}`,    // mixed number and label set
+	`a in {b c}`,     // missing comma
+	`a == yes`,       // only true and false may be bare
+	`a < true`,       // booleans can't be compared
+	`has_profile(a)`, // profile ID must be a string
+	`has_profile()`,  // missing profile ID
+	`has_prefix()`,   // missing prefix
+	`a contains 1`,   // contains with numeric literal
+	`a contains`,     // missing literal
+	`a sep ","`,      // sep without contains
+	`has_prefix('')`, // prefix must not be quoted
 }
 
 var canonicalisationTests = []struct {
@@ -174,6 +407,487 @@ var canonicalisationTests = []struct {
 	{`a == "'"`, `a == "'"`, ""},
 	{`a == '"'`, `a == '"'`, ""},
 	{`a!='"'`, `a != '"'`, ""},
+	{`a>3`, `a > 3`, ""},
+	{`a >= 3.0`, `a >= 3`, ""},
+	{`a<-1.50`, `a < -1.5`, ""},
+	{`a <=8080 && b> 0.25`, `a <= 8080 && b > 0.25`, ""},
+	{`a   iequals"Prod"`, `a iequals "Prod"`, ""},
+	{`a iequals '"'`, `a iequals '"'`, ""},
+	{`a=~"^web-[0-9]+$"`, `a =~ "^web-[0-9]+$"`, ""},
+	{`a =~ '^"quoted"$'`, `a =~ '^"quoted"$'`, ""},
+	{`a == 'it\'s'`, `a == "it's"`, ""},
+	{`a == "\"'"`, `a == "\"'"`, ""},
+	{`a == '"\''`, `a == "\"'"`, ""},
+	{`a != "\\"`, `a != "\\"`, ""},
+	{`a == "x\\y"`, `a == "x\y"`, ""},
+	{`a == "x\\\\y"`, `a == "x\\\y"`, ""},
+	{`a iequals "\\\""`, `a iequals '\"'`, ""},
+	{`a in {"c", "a", 'b'}`, `a in {"a", "b", "c"}`, ""},
+	{`a not in {"c","a",'"'}`, `a not in {'"', "a", "c"}`, ""},
+	{`a in {c,"x",b}`, `a in {"x", b, c}`, ""},
+	{`a not in { b }`, `a not in {b}`, ""},
+	{`a in {"b"}`, `a in {"b"}`, ""},
+	{`a in {b}`, `a in {b}`, ""},
+	{`a==true`, `a == true`, ""},
+	{`a != false`, `a != false`, ""},
+	{`a == "true"`, `a == "true"`, ""},
+	{`none( )`, `none()`, "s:fKL8fx1xtQfauX34DzbviSnFkNR5ds755iORTw"},
+	{`!(none())`, `!none()`, ""},
+	{`a in {}`, `a in {}`, ""},
+	{`a in{ }`, `a in {}`, ""},
+	{`a not in {}`, `a not in {}`, ""},
+	{`port in {8080, 80,443.0}`, `port in {80, 443, 8080}`, ""},
+	{`port not in {1.50, -2, 10}`, `port not in {-2, 1.5, 10}`, ""},
+	{`has_profile( 'kns.default' ) && !has_profile("x")`, `has_profile("kns.default") && !has_profile("x")`, ""},
+	{`a contains'b'`, `a contains "b"`, ""},
+	{`a contains "b" sep ","`, `a contains "b"`, ""},
+	{`a contains "b" sep '|' && has(c)`, `a contains "b" sep "|" && has(c)`, ""},
+	{`has_prefix( projectcalico.org/ )`, `has_prefix(projectcalico.org/)`, "s:QR8KvTxcTYTw6P_9onRIRB1mu34aTaU6H2rc7Q"},
+	{`!(a in {"x","y"}) && has(b)`, `!a in {"x", "y"} && has(b)`, "s:uvb_KtCrR1fpMtEGo6GSRdu6XJXsnonZiLmIHQ"},
+	{`!(a not in {"x"}) || !(b in {"y"})`, `!a not in {"x"} || !b in {"y"}`, "s:7LTL5c4QmtgObakd3DI5SsHg8RwGPVjp3GGqpg"},
+	{`((a in {"x"}) || b == "c") && d not in {"e"}`, `(a in {"x"} || b == "c") && d not in {"e"}`, "s:eqTcMhTTbsWv89d74mlKdV1_xE_Yz2qVtOzTHw"},
+	{`a in {"x"} || (b == "c" && (d not in {"e"}))`, `a in {"x"} || b == "c" && d not in {"e"}`, "s:bW1VBB1jbI-CGN6qDmhZthudWrM7sC2A2tsi_Q"},
+	{`!(!(a in {"x"} && !(b not in {"y"} || has(c))))`, `a in {"x"} && !(b not in {"y"} || has(c))`, "s:-KDMuDe3v1MIAJjjQHw4aNPkED8T3JxEO2tGfQ"},
+	{`!((a in {"x"} || b in {"y"}) && !(c not in {"z"}))`, `!((a in {"x"} || b in {"y"}) && !c not in {"z"})`, "s:XMquqtgYiSA6-DSyDhBwOnQr5wmJuSOFD4VSkg"},
+	{`((((a in {"x"}))))`, `a in {"x"}`, "s:LIEAMYtAwWnEUL6GFeidjkTht5bQ0nxyaWKABw"},
+	{`(a == "x" || has_profile("p")) && !b == "y"`, `(a == "x" || has_profile("p")) && !b == "y"`, "s:c8k4MnAqzo1dr47UnejkcuRSmqFsD9qL3f-veg"},
+	{`a == "x" || (has_profile("p") && !b == "y")`, `a == "x" || has_profile("p") && !b == "y"`, "s:Csh7LqrN2XmLPOfK3feXGkHptKbafX0slhk4QA"},
+	{`(a=="x"||has_profile( "p" ))&&(has_profile('q')||!has(c))`, `(a == "x" || has_profile("p")) && (has_profile("q") || !has(c))`, "s:R6y7B4ocYaqIY9Sn9ese4n9KC7OtoYBJg3HoaA"},
+	{`!(has_profile("p") || (a == "x"))`, `!(has_profile("p") || a == "x")`, "s:mNW4bHk5WF7F-6JTxEQFtGcC0VNkZHYUfFo32w"},
+	{`!(has_profile("p") && a == "x")`, `!(has_profile("p") && a == "x")`, "s:LIHy5SrsNHdmJJ7kwMAyZctEIk4sQUgYgUEtKQ"},
+	{`!has_profile("p") && (b == "y" || (c == "z" && has_profile("q")))`, `!has_profile("p") && (b == "y" || c == "z" && has_profile("q"))`, "s:4UTkuNNPM2-bvr0EXcXQnzgdcY24-1lp92sLbg"},
+	{`!!((has_profile("p")))`, `has_profile("p")`, "s:l5GpTUqmq0wLII33s8ouv5JcfXMhgFcZQprBfg"},
+}
+
+var labelKeysTests = []struct {
+	input    string
+	expected []string
+}{
+	{"", []string{}},
+	{"all()", []string{}},
+	{`a == "b"`, []string{"a"}},
+	{`has(b) && a != "c"`, []string{"a", "b"}},
+	{`!(a in {"x"} || b not in {"y"}) && a == "z"`, []string{"a", "b"}},
+	{`c > 1 || c <= 2 || b iequals "x" || a =~ "y"`, []string{"a", "b", "c"}},
+	{`a in {c, "x"} || b not in {a}`, []string{"a", "b", "c"}},
+}
+
+var operatorsTests = []struct {
+	input    string
+	expected []string
+}{
+	{"", []string{"all"}},
+	{`a == "b"`, []string{"=="}},
+	{`a == "b" && c != "d" || !has(e)`, []string{"!", "!=", "&&", "==", "has", "||"}},
+	{`a in {"b"} && c not in {1, 2}`, []string{"&&", "in", "not in"}},
+	{`a < 1 || a <= 2 || a > 3 || a >= 4`, []string{"<", "<=", ">", ">=", "||"}},
+	{`a iequals "b" && a =~ "c"`, []string{"&&", "=~", "iequals"}},
+	{`a contains "b" sep ";"`, []string{"contains"}},
+	{`has_profile("p") || has_prefix(k8s/)`, []string{"has_prefix", "has_profile", "||"}},
+	{`a in {b} && c not in {"x", d}`, []string{"&&", "in", "not in"}},
+	{`a == true || b != false`, []string{"!=", "==", "||"}},
+	{`none() || has(a)`, []string{"has", "none", "||"}},
+}
+
+var constantConstraintsTests = []struct {
+	input       string
+	expected    map[string][]string
+	expressible bool
+}{
+	{"", map[string][]string{}, true},
+	{`a == "b"`, map[string][]string{"a": {"b"}}, true},
+	{`a == "b" && c in {"e", "d"} && (f == "g" && all())`,
+		map[string][]string{"a": {"b"}, "c": {"d", "e"}, "f": {"g"}}, true},
+	{`a in {"x", "y", "z"} && a in {"y", "z"} && a != "q" || !all()`, nil, false},
+	{`a in {"x", "y", "z"} && a in {"z", "y", "w"}`, map[string][]string{"a": {"y", "z"}}, true},
+	{`a == "x" && a == "y"`, map[string][]string{"a": {}}, true},
+	{`a == "b" || c == "d"`, nil, false},
+	{`a == "b" && !c == "d"`, nil, false},
+	{`a == "b" && has(c)`, nil, false},
+	{`a not in {"b"}`, nil, false},
+	{`a in {80, 443}`, nil, false},
+	{`!all()`, nil, false},
+}
+
+var explainTests = []struct {
+	input     string
+	labels    map[string]string
+	expMatch  bool
+	expReason string
+}{
+	{`a == "b"`, map[string]string{"a": "b"}, true, ""},
+	{`a == "b"`, map[string]string{"a": "c"}, false, `a == "b" failed: a was "c"`},
+	{`a == "b"`, map[string]string{}, false, `a == "b" failed: a was not present`},
+	{`a == "b" && c == "d"`, map[string]string{"a": "b", "c": "e"}, false,
+		`c == "d" failed: c was "e"`},
+	{`has(a) && b in {"x"}`, map[string]string{"a": "", "b": "y"}, false,
+		`b in {"x"} failed: b was "y"`},
+	{`a == "b" || c > 3`, map[string]string{"c": "1"}, false,
+		`a == "b" failed: a was not present; c > 3 failed: c was "1"`},
+	{`!has(a)`, map[string]string{"a": "b"}, false, `!has(a) failed: has(a) matched`},
+	{`a in {c, b}`, map[string]string{"a": "x", "b": "y"}, false,
+		`a in {b, c} failed: a was "x", b was "y", c was not present`},
+	{`none()`, map[string]string{"a": "b"}, false, `none() matches nothing`},
+	{`a == "b" || c > 3`, map[string]string{"c": "4"}, true, ""},
+}
+
+// prefixLabelKeys is a Transform function that prefixes the label key of every
+// node that tests a label with "k8s/".
+func prefixLabelKeys(n Node) Node {
+	const prefix = "k8s/"
+	switch n := n.(type) {
+	case LabelEqValueNode:
+		n.LabelName = prefix + n.LabelName
+		return n
+	case LabelNeValueNode:
+		n.LabelName = prefix + n.LabelName
+		return n
+	case LabelIEqValueNode:
+		n.LabelName = prefix + n.LabelName
+		return n
+	case LabelRegexNode:
+		n.LabelName = prefix + n.LabelName
+		return n
+	case LabelContainsNode:
+		n.LabelName = prefix + n.LabelName
+		return n
+	case LabelInSetNode:
+		n.LabelName = prefix + n.LabelName
+		return n
+	case LabelNotInSetNode:
+		n.LabelName = prefix + n.LabelName
+		return n
+	case LabelInNumberSetNode:
+		n.LabelName = prefix + n.LabelName
+		return n
+	case LabelNotInNumberSetNode:
+		n.LabelName = prefix + n.LabelName
+		return n
+	case LabelEqBoolNode:
+		n.LabelName = prefix + n.LabelName
+		return n
+	case LabelNeBoolNode:
+		n.LabelName = prefix + n.LabelName
+		return n
+	case LabelInRefSetNode:
+		n.LabelName = prefix + n.LabelName
+		n.Refs = prefixRefs(prefix, n.Refs)
+		return n
+	case LabelNotInRefSetNode:
+		n.LabelName = prefix + n.LabelName
+		n.Refs = prefixRefs(prefix, n.Refs)
+		return n
+	case LabelLtValueNode:
+		n.LabelName = prefix + n.LabelName
+		return n
+	case LabelLeValueNode:
+		n.LabelName = prefix + n.LabelName
+		return n
+	case LabelGtValueNode:
+		n.LabelName = prefix + n.LabelName
+		return n
+	case LabelGeValueNode:
+		n.LabelName = prefix + n.LabelName
+		return n
+	case HasNode:
+		n.LabelName = prefix + n.LabelName
+		return n
+	case HasPrefixNode:
+		n.Prefix = prefix + n.Prefix
+		return n
+	}
+	return n
+}
+
+func prefixRefs(prefix string, refs map[string]bool) map[string]bool {
+	prefixed := make(map[string]bool, len(refs))
+	for ref := range refs {
+		prefixed[prefix+ref] = true
+	}
+	return prefixed
+}
+
+// combineTests lists groups of selectors to combine with AndSelectors and
+// OrSelectors.
+var combineTests = [][]string{
+	{`a == "b"`},
+	{`a == "b"`, `has(c)`},
+	{`a == "b" || c == "d"`, `e in {"f", "g"}`},
+	{`a == "b" && c == "d"`, `!has(e)`, `f > 10`},
+	{`all()`, `a == "b"`},
+}
+
+// combineLabels are the label maps that combined selectors are evaluated on.
+var combineLabels = []map[string]string{
+	{},
+	{"a": "b"},
+	{"a": "b", "c": "d"},
+	{"c": "d", "e": "f"},
+	{"a": "b", "e": "g", "f": "11"},
+	{"f": "9"},
+}
+
+// simplifyTests maps selectors to their expected simplified form.
+var simplifyTests = []struct {
+	input    string
+	expected string
+}{
+	{`all()`, `all()`},
+	{`a == "b"`, `a == "b"`},
+	{`all() && a == "b"`, `a == "b"`},
+	{`a == "b" && all() && c == "d"`, `a == "b" && c == "d"`},
+	{`x == "y" || all()`, `all()`},
+	{`none() || a == "b"`, `a == "b"`},
+	{`a == "b" || none()`, `a == "b"`},
+	{`none() && a == "b"`, `none()`},
+	{`a == "b" && (c == "d" || none())`, `a == "b" && c == "d"`},
+	{`has(a) && none()`, `none()`},
+	{`none() || none()`, `none()`},
+	{`!none()`, `all()`},
+	{`!none() && has(a)`, `has(a)`},
+	{`!(none() || !has(a))`, `has(a)`},
+	{`!all() || a == "b"`, `a == "b"`},
+	{`!all() && a == "b"`, `!all()`},
+	{`a == "b" && a == "b"`, `a == "b"`},
+	{`a == "b" || c == "d" || a == "b"`, `a == "b" || c == "d"`},
+	{`(a == "b" && c == "d") && (e == "f" && a == "b")`, `a == "b" && c == "d" && e == "f"`},
+	{`(a == "b" || c == "d") || e == "f"`, `a == "b" || c == "d" || e == "f"`},
+	{`!(!has(a))`, `has(a)`},
+	{`!(all() && has(a))`, `!has(a)`},
+	{`(all() && all()) || (has(a) && !has(a))`, `all()`},
+	{`has(a) && (b in {"c"} || !all())`, `has(a) && b in {"c"}`},
+}
+
+// randomLabels returns a label map built from a small set of keys and values
+// so that randomly generated maps frequently match the test selectors.
+func randomLabels(r *rand.Rand) map[string]string {
+	keys := []string{"a", "b", "c", "e", "x"}
+	values := []string{"b", "c", "d", "f", "y"}
+	labels := make(map[string]string)
+	for _, key := range keys {
+		if r.Intn(2) == 0 {
+			labels[key] = values[r.Intn(len(values))]
+		}
+	}
+	return labels
+}
+
+// jsonTests lists selectors and their expected JSON encodings.
+var jsonTests = []struct {
+	input    string
+	expected string
+}{
+	{"", `"all()"`},
+	{"all()", `"all()"`},
+	{`a == "b"`, `"a == \"b\""`},
+	{`!(a in {"x","y"}) && (has(b) || c >= 10)`, `"!a in {\"x\", \"y\"} \u0026\u0026 (has(b) || c \u003e= 10)"`},
+}
+
+// jsonHolder is a struct embedding a selector, as a user of JSONSelector
+// would.
+type jsonHolder struct {
+	Name     string       `json:"name"`
+	Selector JSONSelector `json:"selector"`
+}
+
+// failingReader returns its data and then fails.
+type failingReader struct {
+	data string
+}
+
+func (r failingReader) Read(p []byte) (int, error) {
+	return copy(p, r.data), errors.New("connection reset")
+}
+
+// foreignSelector is a Selector implemented outside the parser package, with
+// the given string form.
+type foreignSelector struct {
+	Selector
+	str string
+}
+
+func (s foreignSelector) String() string {
+	return s.str
+}
+
+// comparisonTests lists pairs of selectors with whether they are equal and
+// whether the first implies the second.
+var comparisonTests = []struct {
+	sel, other string
+	expEqual   bool
+	expImplies bool
+}{
+	{`a == "b"`, `a == "b"`, true, true},
+	{`a=="b"&&c=="d"`, `a == "b" && c == "d"`, true, true},
+	{`a in {"y", "x"}`, `a in {"x", "y"}`, true, true},
+	{`a == "b" && c == "d"`, `a == "b"`, false, true},
+	{`a == "b"`, `a == "b" && c == "d"`, false, false},
+	{`a == "b"`, `a == "b" || c == "d"`, false, true},
+	{`a == "b" || c == "d"`, `a == "b"`, false, false},
+	{`a == "b" && c == "d" && e == "f"`, `e == "f" && a == "b"`, false, true},
+	{`a == "b" || (a == "b" && c == "d")`, `a == "b"`, false, true},
+	{`(a == "b" || c == "d") && e == "f"`, `a == "b" || c == "d"`, false, true},
+	{`a == "b"`, `all()`, false, true},
+	{`all()`, `a == "b"`, false, false},
+	{`!all()`, `a == "b"`, false, true},
+	{`none()`, `a == "b"`, false, true},
+	{`a == "b"`, `none()`, false, false},
+	{`none()`, `!all()`, false, true},
+	{`a == "b"`, `c == "d"`, false, false},
+	{`a == "b"`, `a != "b"`, false, false},
+	{`has(a)`, `!has(b)`, false, false},
+	// A false negative: a == "b" implies has(a) but Implies doesn't
+	// reason about label values.
+	{`a == "b"`, `has(a)`, false, false},
+}
+
+// parseErrorTests lists some bad selectors and the errors they produce.
+var parseErrorTests = []struct {
+	input  string
+	expErr ParseError
+}{
+	{`%`, ParseError{Offset: 0, Token: "%", Msg: "unexpected characters"}},
+	{`a == "b" && %`, ParseError{Offset: 12, Token: "%", Msg: "unexpected characters"}},
+	{`a == "b" &`, ParseError{Offset: 9, Token: "&", Msg: "expected &&"}},
+	{`a == "b`, ParseError{Offset: 5, Token: `"`, Msg: "unterminated string"}},
+	{`a == "C:\"`, ParseError{Offset: 5, Token: `"`, Msg: `unterminated string (\" escapes the quote; use \\ for a literal backslash)`}},
+	{`a > "3"`, ParseError{Offset: 4, Token: `"3"`, Msg: "Expected number"}},
+	{`a  == 3`, ParseError{Offset: 6, Token: "3", Msg: "Expected string"}},
+	{`(a == "foo"`, ParseError{Offset: 11, Msg: "Expected )"}},
+	{`has(foo) &&`, ParseError{Offset: 11, Msg: "Unexpected token"}},
+	{`a in {1, "2"}`, ParseError{Offset: 9, Token: `"2"`, Msg: "Set literal mixes strings and numbers"}},
+	{`a in {"1", 2, 3}`, ParseError{Offset: 11, Token: "2", Msg: "Set literal mixes strings and numbers"}},
+	{`a in {b, 2, "c"}`, ParseError{Offset: 9, Token: "2", Msg: "Set literal mixes numbers and label references"}},
+	{`a in {2, "c", b}`, ParseError{Offset: 9, Token: `"c"`, Msg: "Set literal mixes strings and numbers"}},
+	{`has(a) has(b)`, ParseError{Offset: 7, Token: "has(b)", Msg: "unexpected content at end of selector"}},
+	{`a b`, ParseError{Offset: 2, Token: "b", Msg: "Expected comparison operator"}},
+	{`a contains "b" sep`, ParseError{Offset: 18, Msg: "Expected string"}},
+	{`a contains "b" sep ""`, ParseError{Offset: 19, Token: `""`, Msg: "Separator must not be empty"}},
+}
+
+// multiValueTests lists selectors with multi-valued labels that they should
+// and should not match via EvaluateMulti.
+var multiValueTests = []struct {
+	sel           string
+	expMatches    []map[string][]string
+	expNonMatches []map[string][]string
+}{
+	// Positive tests match if any value matches...
+	{`a == "b"`,
+		[]map[string][]string{{"a": {"b"}}, {"a": {"c", "b"}}},
+		[]map[string][]string{{}, {"a": {}}, {"a": {"c", "d"}}}},
+	{`a in {"b", "c"}`,
+		[]map[string][]string{{"a": {"x", "c"}}},
+		[]map[string][]string{{"a": {"x", "y"}}, {"a": {}}}},
+	{`a > 10`,
+		[]map[string][]string{{"a": {"1", "11"}}},
+		[]map[string][]string{{"a": {"1", "x"}}}},
+	{`a =~ "^b"`,
+		[]map[string][]string{{"a": {"x", "bc"}}},
+		[]map[string][]string{{"a": {"cb"}}}},
+	// ...whereas negated tests require all values to differ.
+	{`a != "b"`,
+		[]map[string][]string{{}, {"a": {}}, {"a": {"c", "d"}}},
+		[]map[string][]string{{"a": {"b"}}, {"a": {"c", "b"}}}},
+	{`a not in {"b", "c"}`,
+		[]map[string][]string{{}, {"a": {"x", "y"}}},
+		[]map[string][]string{{"a": {"x", "c"}}}},
+	{`a not in {1}`,
+		[]map[string][]string{{"a": {"2", "x"}}},
+		[]map[string][]string{{"a": {"2", "1.0"}}}},
+	// "!" negates the whole test, so !a == "b" is the opposite of a == "b".
+	{`!a == "b"`,
+		[]map[string][]string{{}, {"a": {"c", "d"}}},
+		[]map[string][]string{{"a": {"c", "b"}}}},
+	{`has(a) && has_prefix(b) && a != "x"`,
+		[]map[string][]string{{"a": {}, "bc": {}}, {"a": {"y"}, "b": {"z"}}},
+		[]map[string][]string{{"a": {}}, {"a": {"y", "x"}, "b": {"z"}}}},
+	{`a in {b, "x"}`,
+		[]map[string][]string{{"a": {"y", "x"}}, {"a": {"y"}, "b": {"z", "y"}}},
+		[]map[string][]string{{"a": {"y"}}, {"a": {"y"}, "b": {}}, {"b": {"y"}}}},
+	{`a not in {b}`,
+		[]map[string][]string{{"a": {"y"}}, {"a": {"y"}, "b": {"z", "x"}}},
+		[]map[string][]string{{"a": {"y", "z"}, "b": {"z"}}}},
+	{`a == true`,
+		[]map[string][]string{{"a": {"x", "1"}}},
+		[]map[string][]string{{}, {"a": {"x", "0"}}}},
+	{`a != true`,
+		[]map[string][]string{{}, {"a": {"x", "0"}}},
+		[]map[string][]string{{"a": {"x", "yes"}}}},
+}
+
+// profileTests lists selectors with the profile IDs they should and should
+// not match, for an endpoint with no labels.
+var profileTests = []struct {
+	sel           string
+	expMatches    [][]string
+	expNonMatches [][]string
+}{
+	{`has_profile("kns.default")`,
+		[][]string{{"kns.default"}, {"a", "kns.default"}},
+		[][]string{nil, {}, {"kns.other"}, {"kns.default2"}}},
+	{`!has_profile("a")`,
+		[][]string{nil, {"b"}},
+		[][]string{{"a"}, {"b", "a"}}},
+	{`has_profile("a") || has_profile("b")`,
+		[][]string{{"a"}, {"b"}, {"c", "b"}},
+		[][]string{nil, {"c"}}},
+	{`has_profile("a") && has_profile("b")`,
+		[][]string{{"a", "b"}},
+		[][]string{{"a"}, {"b"}}},
+}
+
+// strictTests lists selectors with labels and the result and error that
+// EvaluateStrict should give.
+var strictTests = []struct {
+	sel      string
+	labels   map[string]string
+	expMatch bool
+	expErr   error
+}{
+	{`port > 3`, map[string]string{"port": "8080"}, true, nil},
+	{`port > 3`, map[string]string{}, false, nil},
+	{`port > 3`, map[string]string{"port": "abc"}, false,
+		ValueTypeError{Expr: "port > 3", LabelName: "port", Value: "abc", Type: "number"}},
+	{`port <= 3 || port >= 10`, map[string]string{"port": ""}, false,
+		ValueTypeError{Expr: "port <= 3", LabelName: "port", Value: "", Type: "number"}},
+	{`!port < 3`, map[string]string{"port": "x"}, false,
+		ValueTypeError{Expr: "port < 3", LabelName: "port", Value: "x", Type: "number"}},
+	{`port in {80, 443}`, map[string]string{"port": "http"}, false,
+		ValueTypeError{Expr: "port in {80, 443}", LabelName: "port", Value: "http", Type: "number"}},
+	{`port not in {80}`, map[string]string{"port": "http"}, false,
+		ValueTypeError{Expr: "port not in {80}", LabelName: "port", Value: "http", Type: "number"}},
+	{`privileged == true`, map[string]string{"privileged": "Yes"}, true, nil},
+	{`privileged != false`, map[string]string{"privileged": "maybe"}, false,
+		ValueTypeError{Expr: "privileged != false", LabelName: "privileged", Value: "maybe", Type: "boolean"}},
+	// Evaluation stops once the result is decided.
+	{`a == "b" && port > 3`, map[string]string{"port": "abc"}, false, nil},
+	{`a == "b" || port > 3`, map[string]string{"a": "b", "port": "abc"}, true, nil},
+	{`a == "b" && port > 3`, map[string]string{"a": "b", "port": "abc"}, false,
+		ValueTypeError{Expr: "port > 3", LabelName: "port", Value: "abc", Type: "number"}},
+	// String comparisons never fail.
+	{`port == "abc" && a != "3"`, map[string]string{"port": "abc", "a": "1"}, true, nil},
+}
+
+// mixedProfileTests lists selectors that mix label tests and has_profile(),
+// with whether they should match the given labels and profile IDs.
+var mixedProfileTests = []struct {
+	sel        string
+	labels     map[string]string
+	profileIDs []string
+	expMatch   bool
+}{
+	{`(a == "x" || has_profile("p")) && !b == "y"`, map[string]string{"a": "x"}, nil, true},
+	{`(a == "x" || has_profile("p")) && !b == "y"`, map[string]string{}, []string{"p"}, true},
+	{`(a == "x" || has_profile("p")) && !b == "y"`, map[string]string{"b": "y"}, []string{"p"}, false},
+	{`(a == "x" || has_profile("p")) && !b == "y"`, map[string]string{}, []string{"q"}, false},
+	// Without the parentheses, && binds more tightly than ||.
+	{`a == "x" || has_profile("p") && !b == "y"`, map[string]string{"a": "x", "b": "y"}, nil, true},
+	{`a == "x" || has_profile("p") && !b == "y"`, map[string]string{"b": "y"}, []string{"p"}, false},
+	{`!(has_profile("p") || a == "x")`, map[string]string{"a": "z"}, []string{"q"}, true},
+	{`!(has_profile("p") || a == "x")`, map[string]string{"a": "x"}, []string{"q"}, false},
+	{`!has_profile("p") && (b == "y" || c == "z" && has_profile("q"))`, map[string]string{"c": "z"}, []string{"q"}, true},
+	{`!has_profile("p") && (b == "y" || c == "z" && has_profile("q"))`, map[string]string{"c": "z"}, []string{"p", "q"}, false},
 }
 
 var _ = Describe("Parser", func() {
@@ -198,6 +912,31 @@ var _ = Describe("Parser", func() {
 					Expect(sel.Evaluate(labels)).To(BeFalse())
 				}
 			})
+			It("should give the same results via EvaluateFunc", func() {
+				for _, labels := range test.expMatches {
+					By(fmt.Sprintf("%#v matching %v", test.sel, labels))
+					Expect(sel.EvaluateFunc(LabelsGetter(labels))).To(BeTrue())
+				}
+				for _, labels := range test.expNonMatches {
+					By(fmt.Sprintf("%#v not matching %v", test.sel, labels))
+					Expect(sel.EvaluateFunc(LabelsGetter(labels))).To(BeFalse())
+				}
+			})
+			It("should give the same results via EvaluateMulti with single values", func() {
+				multi := func(labels map[string]string) map[string][]string {
+					result := map[string][]string{}
+					for k, v := range labels {
+						result[k] = []string{v}
+					}
+					return result
+				}
+				for _, labels := range test.expMatches {
+					Expect(sel.EvaluateMulti(multi(labels))).To(BeTrue(), fmt.Sprint(labels))
+				}
+				for _, labels := range test.expNonMatches {
+					Expect(sel.EvaluateMulti(multi(labels))).To(BeFalse(), fmt.Sprint(labels))
+				}
+			})
 			It("should match after canonicalising", func() {
 				for _, labels := range test.expMatches {
 					sel2, err := Parse(sel.String())
@@ -217,6 +956,141 @@ var _ = Describe("Parser", func() {
 		})
 	}
 
+	It("should evaluate against layered label sources via EvaluateFunc", func() {
+		endpointLabels := map[string]string{"a": "endpoint"}
+		profileLabels := map[string]string{"a": "profile", "b": "profile"}
+		get := func(key string) (string, bool) {
+			if val, ok := endpointLabels[key]; ok {
+				return val, true
+			}
+			val, ok := profileLabels[key]
+			return val, ok
+		}
+		sel, err := Parse(`a == "endpoint" && b == "profile" && !has(c)`)
+		Expect(err).To(BeNil())
+		Expect(sel.EvaluateFunc(get)).To(BeTrue())
+		sel, err = Parse(`a == "profile"`)
+		Expect(err).To(BeNil())
+		Expect(sel.EvaluateFunc(get)).To(BeFalse())
+	})
+
+	for _, test := range selectorTests {
+		test := test
+		It(fmt.Sprintf("should match prefixed labels after transforming %#v", test.sel), func() {
+			sel, err := Parse(test.sel)
+			Expect(err).To(BeNil())
+			transformed := sel.Transform(prefixLabelKeys)
+			prefixed := func(labels map[string]string) map[string]string {
+				result := map[string]string{}
+				for k, v := range labels {
+					result["k8s/"+k] = v
+				}
+				return result
+			}
+			for _, labels := range test.expMatches {
+				Expect(transformed.Evaluate(prefixed(labels))).To(BeTrue())
+			}
+			for _, labels := range test.expNonMatches {
+				Expect(transformed.Evaluate(prefixed(labels))).To(BeFalse())
+			}
+
+			// The transformed selector should have a valid canonical form.
+			roundTripped, err := Parse(transformed.String())
+			Expect(err).To(BeNil())
+			Expect(roundTripped.String()).To(Equal(transformed.String()))
+			Expect(roundTripped.UniqueId()).To(Equal(transformed.UniqueId()))
+		})
+	}
+
+	It("should recalculate the string and UID after transforming", func() {
+		sel, err := Parse(`a == "b" && !has(c)`)
+		Expect(err).To(BeNil())
+		transformed := sel.Transform(prefixLabelKeys)
+		Expect(transformed.String()).To(Equal(`k8s/a == "b" && !has(k8s/c)`))
+		Expect(transformed.UniqueId()).NotTo(Equal(sel.UniqueId()))
+		Expect(sel.String()).To(Equal(`a == "b" && !has(c)`))
+	})
+
+	It("should parse valid selectors normally in lenient mode", func() {
+		sel, err := ParseLenient(`a == "b"`, false)
+		Expect(err).To(BeNil())
+		Expect(sel.String()).To(Equal(`a == "b"`))
+	})
+
+	It("should substitute a match-nothing selector in lenient mode", func() {
+		sel, err := ParseLenient(`a == "b" && future_func(c)`, false)
+		Expect(err).To(BeAssignableToTypeOf(ParseError{}))
+		Expect(err).To(Equal(ParseError{Offset: 12, Token: "future_func", Msg: "Unknown function future_func()"}))
+		Expect(sel.String()).To(Equal("none()"))
+		Expect(sel.Evaluate(map[string]string{})).To(BeFalse())
+		Expect(sel.Evaluate(map[string]string{"a": "b", "c": "d"})).To(BeFalse())
+	})
+
+	It("should substitute a match-everything selector in lenient mode if asked", func() {
+		sel, err := ParseLenient(`a ~= "b"`, true)
+		Expect(err).NotTo(BeNil())
+		Expect(sel.String()).To(Equal("all()"))
+		Expect(sel.Evaluate(map[string]string{})).To(BeTrue())
+	})
+
+	It("should distinguish bare booleans from strings", func() {
+		boolSel, err := Parse(`a == true`)
+		Expect(err).To(BeNil())
+		stringSel, err := Parse(`a == "true"`)
+		Expect(err).To(BeNil())
+		Expect(boolSel.UniqueId()).NotTo(Equal(stringSel.UniqueId()))
+		Expect(boolSel.Equal(stringSel)).To(BeFalse())
+		Expect(boolSel.Evaluate(map[string]string{"a": "1"})).To(BeTrue())
+		Expect(stringSel.Evaluate(map[string]string{"a": "1"})).To(BeFalse())
+	})
+
+	Describe("with custom boolean values", func() {
+		var truthy, falsy map[string]bool
+		BeforeEach(func() {
+			truthy, falsy = TruthyLabelValues, FalsyLabelValues
+			TruthyLabelValues = map[string]bool{"enabled": true}
+			FalsyLabelValues = map[string]bool{"disabled": true}
+		})
+		AfterEach(func() {
+			TruthyLabelValues, FalsyLabelValues = truthy, falsy
+		})
+
+		It("should match the configured values", func() {
+			sel, err := Parse(`a == true || b == false`)
+			Expect(err).To(BeNil())
+			Expect(sel.Evaluate(map[string]string{"a": "Enabled"})).To(BeTrue())
+			Expect(sel.Evaluate(map[string]string{"b": "disabled"})).To(BeTrue())
+			Expect(sel.Evaluate(map[string]string{"a": "true", "b": "false"})).To(BeFalse())
+		})
+	})
+
+	It("should parse a selector from a reader", func() {
+		sel, err := ParseReader(strings.NewReader(` a == "b" &&	has(c)`))
+		Expect(err).To(BeNil())
+		Expect(sel.String()).To(Equal(`a == "b" && has(c)`))
+	})
+
+	It("should parse whitespace from a reader as all()", func() {
+		sel, err := ParseReader(strings.NewReader(" \t"))
+		Expect(err).To(BeNil())
+		Expect(sel.String()).To(Equal("all()"))
+	})
+
+	It("should reject an empty reader", func() {
+		_, err := ParseReader(strings.NewReader(""))
+		Expect(err).To(Equal(ErrEmptyInput))
+	})
+
+	It("should report a selector from a reader that fails to parse", func() {
+		_, err := ParseReader(strings.NewReader(`a == "b" &`))
+		Expect(err).To(Equal(ParseError{Offset: 9, Token: "&", Msg: "expected &&"}))
+	})
+
+	It("should report a failing read", func() {
+		_, err := ParseReader(failingReader{`a == "b"`})
+		Expect(err).To(MatchError("failed to read selector: connection reset"))
+	})
+
 	It("Should reject bad selector", func() {
 		for _, sel := range badSelectors {
 			By(fmt.Sprint("Rejecting ", sel))
@@ -241,6 +1115,47 @@ var _ = Describe("Parser", func() {
 		})
 	}
 
+	for _, test := range constantConstraintsTests {
+		test := test
+		It(fmt.Sprintf("should return constraints %v, %v for %#v", test.expected, test.expressible, test.input), func() {
+			sel, err := Parse(test.input)
+			Expect(err).To(BeNil())
+			constraints, ok := sel.ConstantConstraints()
+			Expect(ok).To(Equal(test.expressible))
+			Expect(constraints).To(Equal(test.expected))
+		})
+	}
+
+	for _, test := range operatorsTests {
+		test := test
+		It(fmt.Sprintf("should return operators %v for %#v", test.expected, test.input), func() {
+			sel, err := Parse(test.input)
+			Expect(err).To(BeNil())
+			Expect(sel.Operators()).To(Equal(test.expected))
+		})
+	}
+
+	for _, test := range labelKeysTests {
+		test := test
+		It(fmt.Sprintf("should return label keys %v for %#v", test.expected, test.input), func() {
+			sel, err := Parse(test.input)
+			Expect(err).To(BeNil())
+			Expect(sel.LabelKeys()).To(Equal(test.expected))
+		})
+	}
+
+	for _, test := range explainTests {
+		test := test
+		It(fmt.Sprintf("should explain %#v against %v", test.input, test.labels), func() {
+			sel, err := Parse(test.input)
+			Expect(err).To(BeNil())
+			match, reason := sel.Explain(test.labels)
+			Expect(match).To(Equal(test.expMatch))
+			Expect(match).To(Equal(sel.Evaluate(test.labels)))
+			Expect(reason).To(Equal(test.expReason))
+		})
+	}
+
 	for _, test := range canonicalisationTests {
 		test := test
 		if test.expectedUid == "" {
@@ -253,4 +1168,443 @@ var _ = Describe("Parser", func() {
 				"incorrect UID for "+test.input)
 		})
 	}
+
+	for _, test := range combineTests {
+		test := test
+		for _, combine := range []struct {
+			name string
+			fn   func(sels ...Selector) (Selector, error)
+			op   string
+		}{{"AndSelectors", AndSelectors, " && "}, {"OrSelectors", OrSelectors, " || "}} {
+			combine := combine
+			It(fmt.Sprintf("%s of %v should be equivalent to the parsed form", combine.name, test), func() {
+				sels := make([]Selector, len(test))
+				for i, s := range test {
+					sel, err := Parse(s)
+					Expect(err).To(BeNil())
+					sels[i] = sel
+				}
+				parsed, err := Parse("(" + strings.Join(test, ")"+combine.op+"(") + ")")
+				Expect(err).To(BeNil())
+				combined, err := combine.fn(sels...)
+				Expect(err).To(BeNil())
+				Expect(combined.String()).To(Equal(parsed.String()))
+				Expect(combined.UniqueId()).To(Equal(parsed.UniqueId()))
+				for _, labels := range combineLabels {
+					Expect(combined.Evaluate(labels)).To(Equal(parsed.Evaluate(labels)),
+						fmt.Sprintf("mismatch for labels %v", labels))
+				}
+			})
+		}
+	}
+
+	It("should combine no selectors to all() with AndSelectors", func() {
+		sel, err := AndSelectors()
+		Expect(err).To(BeNil())
+		Expect(sel.String()).To(Equal("all()"))
+		Expect(sel.Evaluate(map[string]string{})).To(BeTrue())
+	})
+
+	It("should combine no selectors to none() with OrSelectors", func() {
+		sel, err := OrSelectors()
+		Expect(err).To(BeNil())
+		Expect(sel.String()).To(Equal("none()"))
+		Expect(sel.Evaluate(map[string]string{})).To(BeFalse())
+	})
+
+	It("should combine selectors from outside the package by re-parsing them", func() {
+		a, err := Parse("has(a)")
+		Expect(err).To(BeNil())
+		b, err := Parse(`b == "c"`)
+		Expect(err).To(BeNil())
+		sel, err := AndSelectors(a, foreignSelector{b, `b == "c"`})
+		Expect(err).To(BeNil())
+		Expect(sel.String()).To(Equal(`has(a) && b == "c"`))
+	})
+
+	It("should return an error if a selector from outside the package does not re-parse", func() {
+		a, err := Parse("has(a)")
+		Expect(err).To(BeNil())
+		bad := foreignSelector{a, "b =="}
+		for _, combine := range []func(sels ...Selector) (Selector, error){AndSelectors, OrSelectors} {
+			sel, err := combine(bad)
+			Expect(err).NotTo(BeNil())
+			Expect(sel).To(BeNil())
+			sel, err = combine(a, bad)
+			Expect(err).NotTo(BeNil())
+			Expect(sel).To(BeNil())
+		}
+	})
+
+	It("should negate all() to a selector that matches nothing", func() {
+		sel, err := Parse("all()")
+		Expect(err).To(BeNil())
+		negated := sel.Negate()
+		Expect(negated.String()).To(Equal("!all()"))
+		Expect(negated.Evaluate(map[string]string{})).To(BeFalse())
+		Expect(negated.Evaluate(map[string]string{"a": "b"})).To(BeFalse())
+		Expect(negated.Negate().String()).To(Equal("all()"))
+	})
+
+	It("should negate to the canonical negated form", func() {
+		for _, test := range []struct{ input, expected string }{
+			{`a == "b"`, `!a == "b"`},
+			{`!has(a)`, `has(a)`},
+			{`has(a) && b != "c"`, `!(has(a) && b != "c")`},
+			{`!(a == "x" || has_profile("p"))`, `a == "x" || has_profile("p")`},
+		} {
+			sel, err := Parse(test.input)
+			Expect(err).To(BeNil())
+			negated := sel.Negate()
+			Expect(negated.String()).To(Equal(test.expected))
+			reparsed, err := Parse(negated.String())
+			Expect(err).To(BeNil())
+			Expect(negated.UniqueId()).To(Equal(reparsed.UniqueId()))
+			Expect(negated.Negate().UniqueId()).To(Equal(sel.UniqueId()))
+		}
+	})
+
+	for _, test := range selectorTests {
+		test := test
+		It(fmt.Sprintf("should negate %#v to its complement", test.sel), func() {
+			sel, err := Parse(test.sel)
+			Expect(err).To(BeNil())
+			negated := sel.Negate()
+			for _, labels := range append(test.expMatches, test.expNonMatches...) {
+				Expect(negated.Evaluate(labels)).To(Equal(!sel.Evaluate(labels)), fmt.Sprint(labels))
+			}
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < 50; i++ {
+				labels := randomLabels(r)
+				Expect(negated.Evaluate(labels)).To(Equal(!sel.Evaluate(labels)), fmt.Sprint(labels))
+			}
+		})
+	}
+
+	for _, test := range simplifyTests {
+		test := test
+		It(fmt.Sprintf("should simplify %#v to %#v", test.input, test.expected), func() {
+			sel, err := Parse(test.input)
+			Expect(err).To(BeNil())
+			Expect(sel.Simplify().String()).To(Equal(test.expected))
+		})
+
+		It(fmt.Sprintf("should evaluate %#v the same after simplifying", test.input), func() {
+			sel, err := Parse(test.input)
+			Expect(err).To(BeNil())
+			simplified := sel.Simplify()
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < 200; i++ {
+				labels := randomLabels(r)
+				Expect(simplified.Evaluate(labels)).To(Equal(sel.Evaluate(labels)),
+					fmt.Sprintf("mismatch for labels %v", labels))
+			}
+		})
+	}
+
+	It("should return the full UniqueId from UniqueIdN with the full hash length", func() {
+		sel, err := Parse(`a == "b"`)
+		Expect(err).To(BeNil())
+		Expect(sel.UniqueIdN(28)).To(Equal(sel.UniqueId()))
+		Expect(sel.UniqueIdN(100)).To(Equal(sel.UniqueId()))
+	})
+
+	It("should return a stable, truncated UniqueIdN", func() {
+		sel, err := Parse(`a == "b"`)
+		Expect(err).To(BeNil())
+		Expect(sel.UniqueIdN(6)).To(Equal("s:flMh0m0X"))
+		Expect(sel.UniqueId()).To(HavePrefix(sel.UniqueIdN(6)))
+	})
+
+	It("should return different UniqueIdNs for different selectors", func() {
+		ids := make(map[string]string)
+		for _, test := range canonicalisationTests {
+			sel, err := Parse(test.input)
+			Expect(err).To(BeNil())
+			id := sel.UniqueIdN(8)
+			Expect(id).To(HavePrefix("s:"))
+			if other, ok := ids[id]; ok {
+				Expect(other).To(Equal(sel.String()), "collision for "+id)
+			}
+			ids[id] = sel.String()
+		}
+	})
+
+	for _, test := range jsonTests {
+		test := test
+		It(fmt.Sprintf("should round-trip %#v through JSON", test.input), func() {
+			sel, err := Parse(test.input)
+			Expect(err).To(BeNil())
+			b, err := json.Marshal(sel)
+			Expect(err).To(BeNil())
+			Expect(string(b)).To(Equal(test.expected))
+
+			b, err = json.Marshal(jsonHolder{Name: "n", Selector: JSONSelector{sel}})
+			Expect(err).To(BeNil())
+			Expect(string(b)).To(Equal(`{"name":"n","selector":` + test.expected + `}`))
+			var holder jsonHolder
+			err = json.Unmarshal(b, &holder)
+			Expect(err).To(BeNil())
+			Expect(holder.Name).To(Equal("n"))
+			Expect(holder.Selector.String()).To(Equal(sel.String()))
+			Expect(holder.Selector.UniqueId()).To(Equal(sel.UniqueId()))
+		})
+	}
+
+	It("should return an error when unmarshaling an invalid selector", func() {
+		var holder jsonHolder
+		err := json.Unmarshal([]byte(`{"selector":"a =="}`), &holder)
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("should return an error when unmarshaling a non-string selector", func() {
+		var holder jsonHolder
+		err := json.Unmarshal([]byte(`{"selector":10}`), &holder)
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("should marshal and unmarshal a nil selector as null", func() {
+		b, err := json.Marshal(jsonHolder{Name: "n"})
+		Expect(err).To(BeNil())
+		Expect(string(b)).To(Equal(`{"name":"n","selector":null}`))
+		all, err := AndSelectors()
+		Expect(err).To(BeNil())
+		holder := jsonHolder{Selector: JSONSelector{all}}
+		err = json.Unmarshal(b, &holder)
+		Expect(err).To(BeNil())
+		Expect(holder.Selector.Selector).To(BeNil())
+	})
+
+	for _, test := range comparisonTests {
+		test := test
+		It(fmt.Sprintf("should compare %#v with %#v", test.sel, test.other), func() {
+			sel, err := Parse(test.sel)
+			Expect(err).To(BeNil())
+			other, err := Parse(test.other)
+			Expect(err).To(BeNil())
+			Expect(sel.Equal(other)).To(Equal(test.expEqual))
+			Expect(other.Equal(sel)).To(Equal(test.expEqual))
+			Expect(sel.Implies(other)).To(Equal(test.expImplies))
+		})
+	}
+
+	It("should not be equal to or imply a nil selector", func() {
+		sel, err := Parse(`a == "b"`)
+		Expect(err).To(BeNil())
+		Expect(sel.Equal(nil)).To(BeFalse())
+		Expect(sel.Implies(nil)).To(BeFalse())
+	})
+
+	It("should not imply a selector from outside the package that does not re-parse", func() {
+		sel, err := Parse(`a == "b"`)
+		Expect(err).To(BeNil())
+		Expect(sel.Implies(foreignSelector{sel, "a =="})).To(BeFalse())
+	})
+
+	for _, test := range parseErrorTests {
+		test := test
+		It(fmt.Sprintf("should report %#v for %#v", test.expErr.Error(), test.input), func() {
+			_, err := Parse(test.input)
+			Expect(err).To(Equal(test.expErr))
+		})
+	}
+
+	It("should format a ParseError", func() {
+		Expect(ParseError{Offset: 5, Token: "%", Msg: "unexpected characters"}.Error()).To(
+			Equal("unexpected '%' at offset 5: unexpected characters"))
+		Expect(ParseError{Offset: 11, Msg: "Expected )"}.Error()).To(
+			Equal("unexpected end of selector at offset 11: Expected )"))
+	})
+
+	It("should reject a pathologically deep selector", func() {
+		deep := strings.Repeat("(", 100000) + "has(a)" + strings.Repeat(")", 100000)
+		_, err := Parse(deep)
+		Expect(err).To(Equal(ParseError{
+			Offset: DefaultMaxNestingDepth,
+			Token:  "(",
+			Msg:    "Selector is nested too deeply",
+		}))
+	})
+
+	It("should accept nesting up to the maximum depth", func() {
+		sel, err := ParseWithMaxNestingDepth("((has(a)))", 2)
+		Expect(err).To(BeNil())
+		Expect(sel.String()).To(Equal("has(a)"))
+		_, err = ParseWithMaxNestingDepth("(((has(a))))", 2)
+		Expect(err).NotTo(BeNil())
+	})
+
+	for _, test := range profileTests {
+		test := test
+		It(fmt.Sprintf("should match profiles correctly for %#v", test.sel), func() {
+			sel, err := Parse(test.sel)
+			Expect(err).To(BeNil())
+			for _, profileIDs := range test.expMatches {
+				Expect(sel.EvaluateWithProfiles(map[string]string{}, profileIDs)).To(BeTrue(),
+					fmt.Sprintf("should match %v", profileIDs))
+			}
+			for _, profileIDs := range test.expNonMatches {
+				Expect(sel.EvaluateWithProfiles(map[string]string{}, profileIDs)).To(BeFalse(),
+					fmt.Sprintf("should not match %v", profileIDs))
+			}
+		})
+	}
+
+	for _, test := range strictTests {
+		test := test
+		It(fmt.Sprintf("should strictly evaluate %#v against %v", test.sel, test.labels), func() {
+			sel, err := Parse(test.sel)
+			Expect(err).To(BeNil())
+			match, err := sel.EvaluateStrict(test.labels)
+			Expect(match).To(Equal(test.expMatch))
+			if test.expErr == nil {
+				Expect(err).To(BeNil())
+				Expect(sel.Evaluate(test.labels)).To(Equal(match))
+			} else {
+				Expect(err).To(Equal(test.expErr))
+			}
+		})
+	}
+
+	It("should format a ValueTypeError", func() {
+		err := ValueTypeError{Expr: "port > 3", LabelName: "port", Value: "abc", Type: "number"}
+		Expect(err.Error()).To(Equal(`port > 3: label port has value "abc", which is not a number`))
+	})
+
+	for _, test := range mixedProfileTests {
+		test := test
+		It(fmt.Sprintf("should evaluate %#v against %v and profiles %v", test.sel, test.labels, test.profileIDs), func() {
+			sel, err := Parse(test.sel)
+			Expect(err).To(BeNil())
+			Expect(sel.EvaluateWithProfiles(test.labels, test.profileIDs)).To(Equal(test.expMatch))
+			// The canonical form must evaluate the same way.
+			canonical, err := Parse(sel.String())
+			Expect(err).To(BeNil())
+			Expect(canonical.EvaluateWithProfiles(test.labels, test.profileIDs)).To(Equal(test.expMatch))
+		})
+	}
+
+	for _, test := range multiValueTests {
+		test := test
+		It(fmt.Sprintf("should match multi-valued labels correctly for %#v", test.sel), func() {
+			sel, err := Parse(test.sel)
+			Expect(err).To(BeNil())
+			for _, labels := range test.expMatches {
+				Expect(sel.EvaluateMulti(labels)).To(BeTrue(), fmt.Sprintf("should match %v", labels))
+			}
+			for _, labels := range test.expNonMatches {
+				Expect(sel.EvaluateMulti(labels)).To(BeFalse(), fmt.Sprintf("should not match %v", labels))
+			}
+		})
+	}
+
+	It("should fall back to default label values", func() {
+		sel, err := Parse(`env == "prod" && tier in {"web", "db"}`)
+		Expect(err).To(BeNil())
+		defaults := map[string]string{"env": "prod"}
+		Expect(sel.Evaluate(map[string]string{"tier": "web"})).To(BeFalse())
+		Expect(sel.EvaluateWithDefaults(map[string]string{"tier": "web"}, defaults)).To(BeTrue())
+		Expect(sel.EvaluateWithDefaults(map[string]string{"tier": "web", "env": "dev"}, defaults)).To(BeFalse())
+		Expect(sel.EvaluateWithDefaults(map[string]string{"tier": "ui"}, defaults)).To(BeFalse())
+		Expect(sel.EvaluateWithDefaults(map[string]string{"tier": "db"}, nil)).To(BeFalse())
+		Expect(sel.EvaluateWithDefaults(map[string]string{}, map[string]string{"env": "prod", "tier": "db"})).To(BeTrue())
+	})
+
+	It("should treat defaulted labels as present", func() {
+		sel, err := Parse(`has(env) && !has(other) && has_prefix(en)`)
+		Expect(err).To(BeNil())
+		Expect(sel.EvaluateWithDefaults(map[string]string{}, map[string]string{"env": "prod"})).To(BeTrue())
+		Expect(sel.EvaluateWithDefaults(map[string]string{"other": ""}, map[string]string{"env": "prod"})).To(BeFalse())
+		Expect(sel.EvaluateWithDefaults(map[string]string{}, map[string]string{})).To(BeFalse())
+	})
+
+	It("should ignore the case of label keys with CaseInsensitiveLabelsGetter", func() {
+		sel, err := Parse(`App == "web" && has(tier) && env in {"Prod"} && has_prefix(K8S/)`)
+		Expect(err).To(BeNil())
+		labels := map[string]string{"app": "web", "TIER": "", "Env": "Prod", "k8s/ns": "default"}
+		Expect(sel.Evaluate(labels)).To(BeFalse())
+		Expect(sel.EvaluateFunc(CaseInsensitiveLabelsGetter(labels))).To(BeTrue())
+
+		// Values are still case sensitive.
+		labels["Env"] = "prod"
+		Expect(sel.EvaluateFunc(CaseInsensitiveLabelsGetter(labels))).To(BeFalse())
+	})
+
+	It("should prefer the lower-case key if keys differ only in case", func() {
+		sel, err := Parse(`app == "web"`)
+		Expect(err).To(BeNil())
+		Expect(sel.EvaluateFunc(CaseInsensitiveLabelsGetter(
+			map[string]string{"APP": "db", "app": "web", "App": "db"}))).To(BeTrue())
+		Expect(sel.EvaluateFunc(CaseInsensitiveLabelsGetter(
+			map[string]string{"App": "web", "aPP": "db"}))).To(BeTrue())
+	})
+
+	It("should look up annotation-prefixed keys in the annotations", func() {
+		sel, err := Parse(`role == "web" && annotation/owner in {"alice", "bob"}`)
+		Expect(err).To(BeNil())
+		labels := map[string]string{"role": "web", "owner": "alice"}
+		Expect(sel.EvaluateWithAnnotations(labels, map[string]string{"owner": "bob"})).To(BeTrue())
+		Expect(sel.EvaluateWithAnnotations(labels, map[string]string{"owner": "carol"})).To(BeFalse())
+		Expect(sel.EvaluateWithAnnotations(labels, nil)).To(BeFalse())
+		Expect(sel.EvaluateWithAnnotations(map[string]string{"role": "db"}, map[string]string{"owner": "bob"})).To(BeFalse())
+		Expect(sel.EvaluateWithAnnotations(map[string]string{"role": "web", "annotation/owner": "bob"}, nil)).To(BeFalse())
+		Expect(sel.EvaluateWithAnnotations(map[string]string{}, map[string]string{"role": "web", "owner": "bob"})).To(BeFalse())
+	})
+
+	It("should route has() and has_prefix() on annotations", func() {
+		sel, err := Parse(`has(annotation/owner) && !has(owner) && has_prefix(annotation/team.)`)
+		Expect(err).To(BeNil())
+		Expect(sel.EvaluateWithAnnotations(nil, map[string]string{"owner": "", "team.name": "x"})).To(BeTrue())
+		Expect(sel.EvaluateWithAnnotations(map[string]string{"team.name": "x"}, map[string]string{"owner": ""})).To(BeFalse())
+		Expect(sel.EvaluateWithAnnotations(map[string]string{"owner": ""}, map[string]string{"owner": "", "team.name": "x"})).To(BeFalse())
+
+		sel, err = Parse(`has_prefix(annotation/)`)
+		Expect(err).To(BeNil())
+		Expect(sel.EvaluateWithAnnotations(map[string]string{"a": "b"}, nil)).To(BeFalse())
+		Expect(sel.EvaluateWithAnnotations(nil, map[string]string{"a": "b"})).To(BeTrue())
+	})
+
+	It("should evaluate labels and profiles together", func() {
+		sel, err := Parse(`has_profile("p") && a == "b"`)
+		Expect(err).To(BeNil())
+		Expect(sel.EvaluateWithProfiles(map[string]string{"a": "b"}, []string{"p"})).To(BeTrue())
+		Expect(sel.EvaluateWithProfiles(map[string]string{"a": "c"}, []string{"p"})).To(BeFalse())
+		Expect(sel.EvaluateWithProfiles(map[string]string{"a": "b"}, []string{"q"})).To(BeFalse())
+		Expect(sel.Evaluate(map[string]string{"a": "b"})).To(BeFalse())
+		Expect(sel.LabelKeys()).To(Equal([]string{"a"}))
+	})
+
+	It("should look up profiles via ProfileLabelKey in EvaluateFunc", func() {
+		sel, err := Parse(`has_profile("p")`)
+		Expect(err).To(BeNil())
+		Expect(sel.EvaluateFunc(func(key string) (string, bool) {
+			return "", key == ProfileLabelKey("p")
+		})).To(BeTrue())
+	})
+
+	It("should look up prefixes via PrefixLabelKey in EvaluateFunc", func() {
+		sel, err := Parse(`has_prefix(k8s/)`)
+		Expect(err).To(BeNil())
+		Expect(sel.EvaluateFunc(func(key string) (string, bool) {
+			return "", key == PrefixLabelKey("k8s/")
+		})).To(BeTrue())
+		Expect(sel.EvaluateWithProfiles(map[string]string{"k8s/a": "b"}, []string{"p"})).To(BeTrue())
+		Expect(sel.LabelKeys()).To(BeEmpty())
+	})
+
+	It("should explain a missing prefix", func() {
+		sel, err := Parse(`has_prefix(k8s/)`)
+		Expect(err).To(BeNil())
+		match, reason := sel.Explain(map[string]string{"a": "k8s/"})
+		Expect(match).To(BeFalse())
+		Expect(reason).To(Equal(`has_prefix(k8s/) failed: no label starting with "k8s/" was present`))
+	})
+
+	It("should explain a missing profile", func() {
+		sel, err := Parse(`has_profile("p")`)
+		Expect(err).To(BeNil())
+		match, reason := sel.Explain(map[string]string{})
+		Expect(match).To(BeFalse())
+		Expect(reason).To(Equal(`has_profile("p") failed: profile "p" was not present`))
+	})
 })
@@ -0,0 +1,135 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+// Simplify returns an equivalent Selector with redundant terms removed:
+// all() and none() are folded out of "&&" and "||" expressions, duplicate
+// operands are dropped, nested "&&"s and "||"s are flattened, and double
+// negations and !none() are collapsed.  The result matches exactly the same
+// labels as the original.
+func (sel selectorRoot) Simplify() Selector {
+	return selectorRoot{root: simplifyNode(sel.root)}
+}
+
+func simplifyNode(n Node) Node {
+	switch n := n.(type) {
+	case NotNode:
+		operand := simplifyNode(n.Operand)
+		if not, ok := operand.(NotNode); ok {
+			return not.Operand
+		}
+		if _, ok := operand.(NoneNode); ok {
+			return AllNode{}
+		}
+		return NotNode{operand}
+	case AndNode:
+		operands := make([]Node, 0, len(n.Operands))
+		for _, op := range flattenOperands(n.Operands, isAndNode) {
+			if _, ok := op.(AllNode); ok {
+				continue
+			}
+			if isNoneNode(op) {
+				return op
+			}
+			operands = append(operands, op)
+		}
+		operands = dedupeNodes(operands)
+		switch len(operands) {
+		case 0:
+			return AllNode{}
+		case 1:
+			return operands[0]
+		}
+		return AndNode{operands}
+	case OrNode:
+		operands := make([]Node, 0, len(n.Operands))
+		// If every operand matches nothing, keep the form of the last.
+		var none Node = NoneNode{}
+		for _, op := range flattenOperands(n.Operands, isOrNode) {
+			if _, ok := op.(AllNode); ok {
+				return op
+			}
+			if isNoneNode(op) {
+				none = op
+				continue
+			}
+			operands = append(operands, op)
+		}
+		operands = dedupeNodes(operands)
+		switch len(operands) {
+		case 0:
+			return none
+		case 1:
+			return operands[0]
+		}
+		return OrNode{operands}
+	default:
+		return n
+	}
+}
+
+// flattenOperands simplifies the given operands and splices in the operands
+// of any that are of the same kind as their parent, as reported by sameKind.
+func flattenOperands(operands []Node, sameKind func(n Node) ([]Node, bool)) []Node {
+	flattened := make([]Node, 0, len(operands))
+	for _, op := range operands {
+		op = simplifyNode(op)
+		if nested, ok := sameKind(op); ok {
+			flattened = append(flattened, nested...)
+		} else {
+			flattened = append(flattened, op)
+		}
+	}
+	return flattened
+}
+
+func isAndNode(n Node) ([]Node, bool) {
+	and, ok := n.(AndNode)
+	return and.Operands, ok
+}
+
+func isOrNode(n Node) ([]Node, bool) {
+	or, ok := n.(OrNode)
+	return or.Operands, ok
+}
+
+// isNoneNode returns true if the node is none() or "!all()", which match
+// nothing.
+func isNoneNode(n Node) bool {
+	if _, ok := n.(NoneNode); ok {
+		return true
+	}
+	if not, ok := n.(NotNode); ok {
+		_, ok = not.Operand.(AllNode)
+		return ok
+	}
+	return false
+}
+
+// dedupeNodes removes operands with the same canonical form as an earlier
+// operand, preserving order.
+func dedupeNodes(nodes []Node) []Node {
+	seen := make(map[string]bool, len(nodes))
+	deduped := nodes[:0]
+	for _, n := range nodes {
+		fragment := fragmentString(n)
+		if seen[fragment] {
+			continue
+		}
+		seen[fragment] = true
+		deduped = append(deduped, n)
+	}
+	return deduped
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ValueTypeError is returned by EvaluateStrict if a label's value can't be
+// interpreted as the type that the selector compares it with, for example if
+// `port > 3` is evaluated against port=abc.
+type ValueTypeError struct {
+	// Expr is the canonical form of the failing part of the selector.
+	Expr      string
+	LabelName string
+	Value     string
+	// Type is the type that the value should have been, "number" or
+	// "boolean".
+	Type string
+}
+
+func (e ValueTypeError) Error() string {
+	return fmt.Sprintf("%s: label %s has value %q, which is not a %s", e.Expr, e.LabelName, e.Value, e.Type)
+}
+
+// EvaluateStrict is like Evaluate but, rather than treating a label value
+// that is not of the type that the selector expects as a non-match, it
+// returns a ValueTypeError.  Numeric comparisons and sets expect numbers and
+// bare booleans expect one of the TruthyLabelValues or FalsyLabelValues.
+// Missing labels are not errors.  "&&" and "||" stop at the first operand
+// that decides the result, so, for example, `has(port) && port > 3` only fails
+// for a non-numeric port.
+func (sel selectorRoot) EvaluateStrict(labels map[string]string) (bool, error) {
+	return evaluateStrictNode(sel.root, LabelsGetter(labels))
+}
+
+func evaluateStrictNode(n Node, get func(key string) (string, bool)) (bool, error) {
+	switch n := n.(type) {
+	case AndNode:
+		for _, op := range n.Operands {
+			if match, err := evaluateStrictNode(op, get); err != nil || !match {
+				return false, err
+			}
+		}
+		return true, nil
+	case OrNode:
+		for _, op := range n.Operands {
+			if match, err := evaluateStrictNode(op, get); err != nil || match {
+				return match, err
+			}
+		}
+		return false, nil
+	case NotNode:
+		match, err := evaluateStrictNode(n.Operand, get)
+		if err != nil {
+			return false, err
+		}
+		return !match, nil
+	case LabelLtValueNode:
+		return evaluateNumeric(n, n.LabelName, get)
+	case LabelLeValueNode:
+		return evaluateNumeric(n, n.LabelName, get)
+	case LabelGtValueNode:
+		return evaluateNumeric(n, n.LabelName, get)
+	case LabelGeValueNode:
+		return evaluateNumeric(n, n.LabelName, get)
+	case LabelInNumberSetNode:
+		return evaluateNumeric(n, n.LabelName, get)
+	case LabelNotInNumberSetNode:
+		return evaluateNumeric(n, n.LabelName, get)
+	case LabelEqBoolNode:
+		return evaluateBool(n, n.LabelName, get)
+	case LabelNeBoolNode:
+		return evaluateBool(n, n.LabelName, get)
+	}
+	return n.EvaluateFunc(get), nil
+}
+
+// evaluateNumeric evaluates a node that compares the label with a number,
+// failing if the label's value is not numeric.
+func evaluateNumeric(n Node, labelName string, get func(key string) (string, bool)) (bool, error) {
+	if val, ok := get(labelName); ok {
+		if _, err := strconv.ParseFloat(val, 64); err != nil {
+			return false, ValueTypeError{fragmentString(n), labelName, val, "number"}
+		}
+	}
+	return n.EvaluateFunc(get), nil
+}
+
+// evaluateBool evaluates a node that compares the label with a boolean,
+// failing if the label's value is not a recognised boolean.
+func evaluateBool(n Node, labelName string, get func(key string) (string, bool)) (bool, error) {
+	if val, ok := get(labelName); ok {
+		lower := strings.ToLower(val)
+		if !TruthyLabelValues[lower] && !FalsyLabelValues[lower] {
+			return false, ValueTypeError{fragmentString(n), labelName, val, "boolean"}
+		}
+	}
+	return n.EvaluateFunc(get), nil
+}
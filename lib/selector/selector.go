@@ -14,15 +14,48 @@
 
 package selector
 
-import "github.com/tigera/libcalico-go/lib/selector/parser"
+import (
+	"io"
+
+	"github.com/tigera/libcalico-go/lib/selector/parser"
+)
 
 type Selector interface {
 	Evaluate(labels map[string]string) bool
+	EvaluateFunc(get func(key string) (string, bool)) bool
+	EvaluateWithProfiles(labels map[string]string, profileIDs []string) bool
+	EvaluateMulti(labels map[string][]string) bool
+	EvaluateWithDefaults(labels, defaults map[string]string) bool
+	EvaluateWithAnnotations(labels, annotations map[string]string) bool
+	EvaluateStrict(labels map[string]string) (bool, error)
 	String() string
 	UniqueId() string
+	UniqueIdN(numBytes int) string
+	Equal(other parser.Selector) bool
+	Implies(other parser.Selector) bool
+	LabelKeys() []string
+	Operators() []string
+	ConstantConstraints() (map[string][]string, bool)
+	Explain(labels map[string]string) (bool, string)
+	Transform(fn func(node parser.Node) parser.Node) parser.Selector
+	Simplify() parser.Selector
+	Negate() parser.Selector
 }
 
 // Parse a string representation of a selector expression into a Selector.
 func Parse(selector string) (sel parser.Selector, err error) {
 	return parser.Parse(selector)
 }
+
+// ParseLenient parses a selector but, if it fails to parse, returns the error
+// along with a placeholder Selector that matches everything if matchOnError is
+// true, or nothing otherwise.
+func ParseLenient(selector string, matchOnError bool) (sel parser.Selector, err error) {
+	return parser.ParseLenient(selector, matchOnError)
+}
+
+// ParseReader reads a selector expression from r and parses it as Parse does.
+// Empty input is an error, whereas whitespace-only input is "all()".
+func ParseReader(r io.Reader) (sel parser.Selector, err error) {
+	return parser.ParseReader(r)
+}
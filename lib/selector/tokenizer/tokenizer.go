@@ -16,16 +16,19 @@ package tokenizer
 
 import (
 	"errors"
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/golang/glog"
 )
 
-type tokenKind uint8
+// TokenKind identifies the type of a Token.
+type TokenKind uint8
 
 const (
-	TokLabel tokenKind = iota + 1
+	TokLabel TokenKind = iota + 1
 	TokStringLiteral
 	TokLBrace
 	TokRBrace
@@ -41,103 +44,184 @@ const (
 	TokRParen
 	TokAnd
 	TokOr
+	TokLt
+	TokLe
+	TokGt
+	TokGe
+	TokNumber
+	TokIEq
+	TokRegex
+	TokHasProfile
+	TokHasPrefix
+	TokContains
+	TokNone
 	TokEof
 )
 
 var whitespace = " \t"
 
 type Token struct {
-	Kind  tokenKind
+	Kind  TokenKind
 	Value interface{}
 }
 
 const (
 	identifierExpr = `[a-zA-Z_./-][a-zA-Z0-9_./-]*`
 	hasExpr        = `has\(\s*(` + identifierExpr + `)\s*\)`
+	hasProfileExpr = `has_profile\s*\(`
+	hasPrefixExpr  = `has_prefix\(\s*(` + identifierExpr + `)\s*\)`
 	allExpr        = `all\(\s*\)`
+	noneExpr       = `none\(\s*\)`
 	notInExpr      = `not\s*in\b`
 	inExpr         = `in\b`
+	iEqualsExpr    = `iequals\b`
+	containsExpr   = `contains\b`
+	numberExpr     = `-?[0-9]+(\.[0-9]+)?\b`
 )
 
 var (
 	identifierRegex = regexp.MustCompile("^" + identifierExpr)
 	hasRegex        = regexp.MustCompile("^" + hasExpr)
+	hasProfileRegex = regexp.MustCompile("^" + hasProfileExpr)
+	hasPrefixRegex  = regexp.MustCompile("^" + hasPrefixExpr)
 	allRegex        = regexp.MustCompile("^" + allExpr)
+	noneRegex       = regexp.MustCompile("^" + noneExpr)
 	notInRegex      = regexp.MustCompile("^" + notInExpr)
 	inRegex         = regexp.MustCompile("^" + inExpr)
+	iEqualsRegex    = regexp.MustCompile("^" + iEqualsExpr)
+	containsRegex   = regexp.MustCompile("^" + containsExpr)
+	numberRegex     = regexp.MustCompile("^" + numberExpr)
 )
 
+// Error is returned by Tokenize if the input contains a syntax error.
+type Error struct {
+	// Offset is the byte offset into the input at which the error was
+	// detected.
+	Offset int
+	Msg    string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("%s at offset %d", e.Msg, e.Offset)
+}
+
 func Tokenize(input string) (tokens []Token, err error) {
+	tokens, _, err = TokenizeWithOffsets(input)
+	return
+}
+
+// TokenizeWithOffsets is like Tokenize but also returns the byte offset into
+// the input of the start of each token.
+func TokenizeWithOffsets(input string) (tokens []Token, offsets []int, err error) {
+	positioned, err := TokenizeWithPositions(input)
+	if err != nil {
+		return nil, nil, err
+	}
+	tokens = make([]Token, len(positioned))
+	offsets = make([]int, len(positioned))
+	for i, t := range positioned {
+		tokens[i] = t.Token
+		offsets[i] = t.Offset
+	}
+	return
+}
+
+// PositionedToken is a token along with its position in the input: the
+// token was scanned from input[Offset:End].  The final TokEof token is
+// empty, with Offset and End both equal to the length of the input.
+type PositionedToken struct {
+	Token
+	Offset int
+	End    int
+}
+
+// TokenizeWithPositions tokenizes the input, exactly as Tokenize does for
+// the parser, and returns each token with its position in the input, for
+// example for syntax highlighting.
+func TokenizeWithPositions(input string) ([]PositionedToken, error) {
+	var positioned []PositionedToken
+	inputLen := len(input)
 	for {
 		glog.V(5).Info("Remaining input: ", input)
 		startLen := len(input)
 		input = strings.TrimLeft(input, whitespace)
+		offset := inputLen - len(input)
 		if len(input) == 0 {
-			tokens = append(tokens, Token{TokEof, nil})
-			return
+			positioned = append(positioned, PositionedToken{Token{TokEof, nil}, offset, offset})
+			return positioned, nil
 		}
+		var token Token
 		switch input[0] {
 		case '(':
-			tokens = append(tokens, Token{TokLParen, nil})
+			token = Token{TokLParen, nil}
 			input = input[1:]
 		case ')':
-			tokens = append(tokens, Token{TokRParen, nil})
-			input = input[1:]
-		case '"':
+			token = Token{TokRParen, nil}
 			input = input[1:]
-			index := strings.Index(input, `"`)
-			if index == -1 {
-				return nil, errors.New("unterminated string")
+		case '"', '\'':
+			var value string
+			var err error
+			value, input, err = scanStringLiteral(input)
+			if err != nil {
+				return nil, Error{offset, err.Error()}
 			}
-			value := input[0:index]
-			tokens = append(tokens, Token{TokStringLiteral, value})
-			input = input[index+1:]
-		case '\'':
-			input = input[1:]
-			index := strings.Index(input, `'`)
-			if index == -1 {
-				return nil, errors.New("unterminated string")
-			}
-			value := input[0:index]
-			tokens = append(tokens, Token{TokStringLiteral, value})
-			input = input[index+1:]
+			token = Token{TokStringLiteral, value}
 		case '{':
-			tokens = append(tokens, Token{TokLBrace, nil})
+			token = Token{TokLBrace, nil}
 			input = input[1:]
 		case '}':
-			tokens = append(tokens, Token{TokRBrace, nil})
+			token = Token{TokRBrace, nil}
 			input = input[1:]
 		case ',':
-			tokens = append(tokens, Token{TokComma, nil})
+			token = Token{TokComma, nil}
 			input = input[1:]
 		case '=':
 			if len(input) > 1 && input[1] == '=' {
-				tokens = append(tokens, Token{TokEq, nil})
+				token = Token{TokEq, nil}
+				input = input[2:]
+			} else if len(input) > 1 && input[1] == '~' {
+				token = Token{TokRegex, nil}
 				input = input[2:]
 			} else {
-				return nil, errors.New("expected ==")
+				return nil, Error{offset, "expected == or =~"}
 			}
 		case '!':
 			if len(input) > 1 && input[1] == '=' {
-				tokens = append(tokens, Token{TokNe, nil})
+				token = Token{TokNe, nil}
+				input = input[2:]
+			} else {
+				token = Token{TokNot, nil}
+				input = input[1:]
+			}
+		case '<':
+			if len(input) > 1 && input[1] == '=' {
+				token = Token{TokLe, nil}
 				input = input[2:]
 			} else {
-				tokens = append(tokens, Token{TokNot, nil})
+				token = Token{TokLt, nil}
+				input = input[1:]
+			}
+		case '>':
+			if len(input) > 1 && input[1] == '=' {
+				token = Token{TokGe, nil}
+				input = input[2:]
+			} else {
+				token = Token{TokGt, nil}
 				input = input[1:]
 			}
 		case '&':
 			if len(input) > 1 && input[1] == '&' {
-				tokens = append(tokens, Token{TokAnd, nil})
+				token = Token{TokAnd, nil}
 				input = input[2:]
 			} else {
-				return nil, errors.New("expected &&")
+				return nil, Error{offset, "expected &&"}
 			}
 		case '|':
 			if len(input) > 1 && input[1] == '|' {
-				tokens = append(tokens, Token{TokOr, nil})
+				token = Token{TokOr, nil}
 				input = input[2:]
 			} else {
-				return nil, errors.New("expected ||")
+				return nil, Error{offset, "expected ||"}
 			}
 		default:
 			// Handle less-simple cases with regex matches.  We've
@@ -148,35 +232,108 @@ func Tokenize(input string) (tokens []Token, err error) {
 				labelNameMatchStart := idxs[2]
 				labelNameMatchEnd := idxs[3]
 				labelName := input[labelNameMatchStart:labelNameMatchEnd]
-				tokens = append(tokens, Token{TokHas, labelName})
+				token = Token{TokHas, labelName}
 				input = input[wholeMatchEnd:]
+			} else if idxs := hasProfileRegex.FindStringIndex(input); idxs != nil {
+				// Found "has_profile(", the parser checks for the
+				// profile ID and closing paren.
+				token = Token{TokHasProfile, nil}
+				input = input[idxs[1]:]
+			} else if idxs := hasPrefixRegex.FindStringSubmatchIndex(input); idxs != nil {
+				// Found "has_prefix(prefix)"
+				prefix := input[idxs[2]:idxs[3]]
+				token = Token{TokHasPrefix, prefix}
+				input = input[idxs[1]:]
 			} else if idxs := notInRegex.FindStringIndex(input); idxs != nil {
 				// Found "not in"
-				tokens = append(tokens, Token{TokNotIn, nil})
+				token = Token{TokNotIn, nil}
 				input = input[idxs[1]:]
 			} else if idxs := inRegex.FindStringIndex(input); idxs != nil {
 				// Found "in"
-				tokens = append(tokens, Token{TokIn, nil})
+				token = Token{TokIn, nil}
+				input = input[idxs[1]:]
+			} else if idxs := iEqualsRegex.FindStringIndex(input); idxs != nil && followsLabel(positioned) {
+				// Found "iequals" in operator position; elsewhere it
+				// is an ordinary label name.
+				token = Token{TokIEq, nil}
+				input = input[idxs[1]:]
+			} else if idxs := containsRegex.FindStringIndex(input); idxs != nil && followsLabel(positioned) {
+				// Found "contains" in operator position.
+				token = Token{TokContains, nil}
 				input = input[idxs[1]:]
 			} else if idxs := allRegex.FindStringIndex(input); idxs != nil {
 				// Found "all"
-				tokens = append(tokens, Token{TokAll, nil})
+				token = Token{TokAll, nil}
+				input = input[idxs[1]:]
+			} else if idxs := noneRegex.FindStringIndex(input); idxs != nil {
+				// Found "none"
+				token = Token{TokNone, nil}
 				input = input[idxs[1]:]
+			} else if idxs := numberRegex.FindStringIndex(input); idxs != nil {
+				// Found a numeric literal.  Checked before identifiers
+				// because an identifier may start with "-".
+				endIndex := idxs[1]
+				value, parseErr := strconv.ParseFloat(input[:endIndex], 64)
+				if parseErr != nil {
+					return nil, Error{offset, "invalid number"}
+				}
+				token = Token{TokNumber, value}
+				input = input[endIndex:]
 			} else if idxs := identifierRegex.FindStringIndex(input); idxs != nil {
 				// Found "label"
 				endIndex := idxs[1]
 				identifier := input[:endIndex]
 				glog.V(4).Info("Identifier ", identifier)
-				tokens = append(tokens, Token{TokLabel, identifier})
+				token = Token{TokLabel, identifier}
 				input = input[endIndex:]
 			} else {
-				err = errors.New("unexpected characters")
-				return
+				return nil, Error{offset, "unexpected characters"}
 			}
 		}
+		// Each case above scans exactly one token.
+		end := inputLen - len(input)
+		positioned = append(positioned, PositionedToken{token, offset, end})
 		if len(input) >= startLen {
-			err = errors.New("infinite loop detected in tokenizer")
-			return
+			return nil, Error{offset, "infinite loop detected in tokenizer"}
+		}
+	}
+}
+
+// followsLabel returns true if the last token scanned was a label, so that the
+// next token is in operator position.  Word operators that were added to the
+// language after labels with the same names may have been in use are only
+// recognised there.
+func followsLabel(positioned []PositionedToken) bool {
+	return len(positioned) > 0 && positioned[len(positioned)-1].Kind == TokLabel
+}
+
+// scanStringLiteral scans a quoted string literal from the start of the input,
+// returning its unescaped value and the remaining input.  Within the literal,
+// a backslash escapes the delimiting quote or another backslash; any other
+// backslash is taken literally.  A literal that ends in a backslash must
+// therefore double it, as in "C:\\", since "C:\" is unterminated: its
+// backslash escapes the closing quote.  (Selectors written before escapes
+// were supported may rely on the old behaviour, so the error for an
+// unterminated literal that contains an escaped quote says so.)
+func scanStringLiteral(input string) (value string, remaining string, err error) {
+	quote := input[0]
+	var buf []byte
+	escapedQuote := false
+	for i := 1; i < len(input); i++ {
+		c := input[i]
+		switch {
+		case c == quote:
+			return string(buf), input[i+1:], nil
+		case c == '\\' && i+1 < len(input) && (input[i+1] == quote || input[i+1] == '\\'):
+			escapedQuote = escapedQuote || input[i+1] == quote
+			buf = append(buf, input[i+1])
+			i++
+		default:
+			buf = append(buf, c)
 		}
 	}
+	if escapedQuote {
+		return "", "", fmt.Errorf(`unterminated string (\%c escapes the quote; use \\ for a literal backslash)`, quote)
+	}
+	return "", "", errors.New("unterminated string")
 }
@@ -110,6 +110,122 @@ var tokenTests = []struct {
 		{TokRBrace, nil},
 		{TokEof, nil},
 	}},
+	{`a<3&&b<=-4.5||c>0 && d>=10`, []Token{
+		{TokLabel, "a"},
+		{TokLt, nil},
+		{TokNumber, float64(3)},
+		{TokAnd, nil},
+		{TokLabel, "b"},
+		{TokLe, nil},
+		{TokNumber, -4.5},
+		{TokOr, nil},
+		{TokLabel, "c"},
+		{TokGt, nil},
+		{TokNumber, float64(0)},
+		{TokAnd, nil},
+		{TokLabel, "d"},
+		{TokGe, nil},
+		{TokNumber, float64(10)},
+		{TokEof, nil},
+	}},
+	{`a iequals "B" && iequalsb == "c"`, []Token{
+		{TokLabel, "a"},
+		{TokIEq, nil},
+		{TokStringLiteral, "B"},
+		{TokAnd, nil},
+		{TokLabel, "iequalsb"},
+		{TokEq, nil},
+		{TokStringLiteral, "c"},
+		{TokEof, nil},
+	}},
+	{`iequals == "x" || iequals-x iequals "y" || !has(a) && iequals.b != "z"`, []Token{
+		{TokLabel, "iequals"},
+		{TokEq, nil},
+		{TokStringLiteral, "x"},
+		{TokOr, nil},
+		{TokLabel, "iequals-x"},
+		{TokIEq, nil},
+		{TokStringLiteral, "y"},
+		{TokOr, nil},
+		{TokNot, nil},
+		{TokHas, "a"},
+		{TokAnd, nil},
+		{TokLabel, "iequals.b"},
+		{TokNe, nil},
+		{TokStringLiteral, "z"},
+		{TokEof, nil},
+	}},
+	{`a=~"^b.*$"`, []Token{
+		{TokLabel, "a"},
+		{TokRegex, nil},
+		{TokStringLiteral, "^b.*$"},
+		{TokEof, nil},
+	}},
+	{`a == "\"x\\" || b == '\'y\\z'`, []Token{
+		{TokLabel, "a"},
+		{TokEq, nil},
+		{TokStringLiteral, `"x\`},
+		{TokOr, nil},
+		{TokLabel, "b"},
+		{TokEq, nil},
+		{TokStringLiteral, `'y\z`},
+		{TokEof, nil},
+	}},
+	{`-a < 1`, []Token{
+		{TokLabel, "-a"},
+		{TokLt, nil},
+		{TokNumber, float64(1)},
+		{TokEof, nil},
+	}},
+	{`has_profile ( "kns.default") && has(has_profile)`, []Token{
+		{TokHasProfile, nil},
+		{TokStringLiteral, "kns.default"},
+		{TokRParen, nil},
+		{TokAnd, nil},
+		{TokHas, "has_profile"},
+		{TokEof, nil},
+	}},
+	{`roles contains "web" sep ";"`, []Token{
+		{TokLabel, "roles"},
+		{TokContains, nil},
+		{TokStringLiteral, "web"},
+		{TokLabel, "sep"},
+		{TokStringLiteral, ";"},
+		{TokEof, nil},
+	}},
+	{`contains == "x" || contains-pii contains "y" || x in {contains/a}`, []Token{
+		{TokLabel, "contains"},
+		{TokEq, nil},
+		{TokStringLiteral, "x"},
+		{TokOr, nil},
+		{TokLabel, "contains-pii"},
+		{TokContains, nil},
+		{TokStringLiteral, "y"},
+		{TokOr, nil},
+		{TokLabel, "x"},
+		{TokIn, nil},
+		{TokLBrace, nil},
+		{TokLabel, "contains/a"},
+		{TokRBrace, nil},
+		{TokEof, nil},
+	}},
+	{`none( ) || !none() && none == "x"`, []Token{
+		{TokNone, nil},
+		{TokOr, nil},
+		{TokNot, nil},
+		{TokNone, nil},
+		{TokAnd, nil},
+		{TokLabel, "none"},
+		{TokEq, nil},
+		{TokStringLiteral, "x"},
+		{TokEof, nil},
+	}},
+	{`has_prefix( k8s.io/ ) || has(has_prefix)`, []Token{
+		{TokHasPrefix, "k8s.io/"},
+		{TokOr, nil},
+		{TokHas, "has_prefix"},
+		{TokEof, nil},
+	}},
 }
 
 var _ = Describe("Token", func() {
@@ -120,4 +236,65 @@ var _ = Describe("Token", func() {
 			Expect(Tokenize(test.input)).To(Equal(test.expected))
 		})
 	}
+
+	It("should return the offset of each token", func() {
+		tokens, offsets, err := TokenizeWithOffsets(` a  == "b"&&!has(c)`)
+		Expect(err).To(BeNil())
+		Expect(tokens).To(HaveLen(len(offsets)))
+		Expect(offsets).To(Equal([]int{1, 4, 7, 10, 12, 13, 19}))
+	})
+
+	It("should return the position of each token", func() {
+		input := ` a  == "b c"&&!has( d ) || e in {1, 'f'}`
+		tokens, err := TokenizeWithPositions(input)
+		Expect(err).To(BeNil())
+		Expect(tokens).To(Equal([]PositionedToken{
+			{Token{TokLabel, "a"}, 1, 2},
+			{Token{TokEq, nil}, 4, 6},
+			{Token{TokStringLiteral, "b c"}, 7, 12},
+			{Token{TokAnd, nil}, 12, 14},
+			{Token{TokNot, nil}, 14, 15},
+			{Token{TokHas, "d"}, 15, 23},
+			{Token{TokOr, nil}, 24, 26},
+			{Token{TokLabel, "e"}, 27, 28},
+			{Token{TokIn, nil}, 29, 31},
+			{Token{TokLBrace, nil}, 32, 33},
+			{Token{TokNumber, float64(1)}, 33, 34},
+			{Token{TokComma, nil}, 34, 35},
+			{Token{TokStringLiteral, "f"}, 36, 39},
+			{Token{TokRBrace, nil}, 39, 40},
+			{Token{TokEof, nil}, 40, 40},
+		}))
+		Expect(input[tokens[5].Offset:tokens[5].End]).To(Equal("has( d )"))
+	})
+
+	It("should return the same tokens as Tokenize", func() {
+		for _, test := range tokenTests {
+			positioned, err := TokenizeWithPositions(test.input)
+			Expect(err).To(BeNil())
+			tokens := []Token{}
+			for _, t := range positioned {
+				tokens = append(tokens, t.Token)
+			}
+			Expect(tokens).To(Equal(test.expected))
+		}
+	})
+
+	It("should reject a literal whose trailing backslash escapes the closing quote", func() {
+		_, err := Tokenize(`a == "C:\" && b == 'd\'`)
+		Expect(err).To(Equal(Error{Offset: 5, Msg: `unterminated string (\" escapes the quote; use \\ for a literal backslash)`}))
+		_, err = Tokenize(`b == 'd\'`)
+		Expect(err).To(Equal(Error{Offset: 5, Msg: `unterminated string (\' escapes the quote; use \\ for a literal backslash)`}))
+		Expect(Tokenize(`a == "C:\\"`)).To(Equal([]Token{
+			{TokLabel, "a"},
+			{TokEq, nil},
+			{TokStringLiteral, `C:\`},
+			{TokEof, nil},
+		}))
+	})
+
+	It("should return the offset of an error", func() {
+		_, err := Tokenize(`a == "b" | c`)
+		Expect(err).To(Equal(Error{Offset: 9, Msg: "expected ||"}))
+	})
 })
@@ -21,6 +21,7 @@ import (
 	"strings"
 
 	"github.com/golang/glog"
+	"github.com/tigera/libcalico-go/lib/backend/model"
 	"github.com/tigera/libcalico-go/lib/errors"
 	"github.com/tigera/libcalico-go/lib/numorstring"
 	"github.com/tigera/libcalico-go/lib/scope"
@@ -34,7 +35,7 @@ var (
 	nameRegex          = regexp.MustCompile("^[a-zA-Z0-9_.-]+$")
 	labelRegex         = regexp.MustCompile("^[a-zA-Z_./-][a-zA-Z0-9_./-]*$")
 	actionRegex        = regexp.MustCompile("^(nextTier|allow|deny)$")
-	backendActionRegex = regexp.MustCompile("^(next-tier|allow|deny)$")
+	backendActionRegex = regexp.MustCompile("^(next-tier|allow|deny|log)$")
 	protocolRegex      = regexp.MustCompile("^(tcp|udp|icmp|icmpv6|sctp|udplite)$")
 )
 
@@ -48,6 +49,7 @@ func init() {
 	RegisterFieldValidator("backendaction", validateBackendAction)
 	RegisterFieldValidator("name", validateName)
 	RegisterFieldValidator("selector", validateSelector)
+	RegisterFieldValidator("backendselector", validateBackendSelector)
 	RegisterFieldValidator("tag", validateTag)
 	RegisterFieldValidator("labels", validateLabels)
 	RegisterFieldValidator("interface", validateInterface)
@@ -57,6 +59,7 @@ func init() {
 
 	RegisterStructValidator(validateProtocol, numorstring.Protocol{})
 	RegisterStructValidator(validatePort, numorstring.Port{})
+	RegisterStructValidator(validateBackendRule, model.Rule{})
 }
 
 func RegisterFieldValidator(key string, fn validator.Func) {
@@ -110,6 +113,20 @@ func validateSelector(v *validator.Validate, topStruct reflect.Value, currentStr
 	return true
 }
 
+// validateBackendSelector validates a selector in the backend model, which,
+// unlike an API selector, must also pass the operator and label allow-lists
+// applied by model.ValidateSelector.
+func validateBackendSelector(v *validator.Validate, topStruct reflect.Value, currentStructOrField reflect.Value, field reflect.Value, fieldType reflect.Type, fieldKind reflect.Kind, param string) bool {
+	s := field.String()
+	glog.V(2).Infof("Validate backend selector: %s\n", s)
+	err := model.ValidateSelector(s)
+	if err != nil {
+		glog.V(2).Infof("Selector %#v was invalid: %v", s, err)
+		return false
+	}
+	return true
+}
+
 func validateTag(v *validator.Validate, topStruct reflect.Value, currentStructOrField reflect.Value, field reflect.Value, fieldType reflect.Type, fieldKind reflect.Kind, param string) bool {
 	s := field.String()
 	glog.V(2).Infof("Validate tag: %s\n", s)
@@ -197,3 +214,13 @@ func validatePort(v *validator.Validate, structLevel *validator.StructLevel) {
 		}
 	}
 }
+
+func validateBackendRule(v *validator.Validate, structLevel *validator.StructLevel) {
+	rule := structLevel.CurrentStruct.Interface().(model.Rule)
+	glog.V(2).Infof("Validate backend rule: %s\n", rule)
+	if err, ok := rule.Validate().(errors.ErrorValidation); ok {
+		for _, f := range err.ErrFields {
+			structLevel.ReportError(reflect.ValueOf(f.Value), f.Name, f.Name, "rule")
+		}
+	}
+}